@@ -0,0 +1,24 @@
+package app
+
+// Aggregator aggregates parsed lines of input by bucket and group-by key and
+// writes aggregated data into [Sink] on commit.
+type Aggregator interface {
+	// Add aggregates netflow. The aggregator can keep netflow.
+	Add(netflow *CSVRecord) error
+	// Commit writes every aggregated data into sink
+	Commit(sink Sink) error
+	// Close releases resources of the aggregator, like temporary files
+	Close() error
+}
+
+// NewAggregator returns [*Approx], if opts want approximate top rows, or exact
+// [*Spiller] otherwise. See [NewApprox] and [NewSpiller] for the rest of
+// arguments.
+func NewAggregator(
+	tmpDir string, memLimit ByteSize, writers int, opts *Options,
+) Aggregator {
+	if opts.Approx > 0 {
+		return NewApprox(tmpDir, memLimit, writers, opts)
+	}
+	return NewSpiller(tmpDir, memLimit, writers, opts)
+}
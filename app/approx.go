@@ -0,0 +1,197 @@
+package app
+
+import (
+	"container/heap"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// approxFactor is num of rows Space-Saving keeps per every reported top row.
+// Spare rows make estimates of top rows more accurate.
+const approxFactor = 4
+
+// maxApprox is the largest --approx, num of rows Space-Saving keeps per bucket
+// must fit into int.
+const maxApprox = math.MaxInt / approxFactor
+
+// approxMetrics are error bounds of counters of approximate top rows
+var approxMetrics = []metric{
+	{name: "PacketsError", column: "packets_error", agg: aggSum},
+	{name: "BytesError", column: "bytes_error", agg: aggSum},
+}
+
+// NewApprox returns initialized [*Approx]. It writes up to writers buckets in
+// parallel on commit, 0 means GOMAXPROCS. When it merges buckets with existing
+// output, it sorts them within memLimit, spilling the rest into private staging
+// dir, created in tmpDir like [NewSpiller] does. opts are settings of
+// aggregation.
+func NewApprox(
+	tmpDir string, memLimit ByteSize, writers int, opts *Options,
+) *Approx {
+	if writers == 0 {
+		writers = runtime.GOMAXPROCS(0)
+	}
+
+	// Report top rows like --top does, it can sum the rest into roll-up row
+	top := *opts
+	if top.Top <= 0 || top.Top > opts.Approx {
+		top.Top = opts.Approx
+	}
+
+	return &Approx{
+		out:     newBucketWriter(tmpDir, &top),
+		limit:   int64(memLimit),
+		writers: writers,
+		opts:    opts,
+		buckets: make(map[string]*spaceSaving),
+	}
+}
+
+// Approx is an alternative to exact aggregation of [Spiller]. It keeps
+// approximate top opts.Approx rows of every bucket by opts.TopBy counter, using
+// Space-Saving algorithm, so it needs fixed memory per bucket regardless of
+// num of keys. Every row has error bounds of its counters in metrics
+// PacketsError and BytesError: true value of counter is at least value minus
+// its error, and at most the value for the ranking counter.
+//
+// Chosen rows depend on order of added records. [ParseInput] passes records
+// in the same order for any num of workers, so output is the same too.
+type Approx struct {
+	out     bucketWriter            // writer of top rows of buckets
+	limit   int64                   // memory limit in bytes
+	writers int                     // num of goroutines writing buckets
+	opts    *Options                // settings of aggregation
+	buckets map[string]*spaceSaving // top rows of every bucket by time ID
+}
+
+// Add adds netflow into top rows of its bucket
+func (self *Approx) Add(netflow *CSVRecord) error {
+	top, present := self.buckets[netflow.TimeID]
+	if !present {
+		top = newSpaceSaving(self.opts)
+		self.buckets[netflow.TimeID] = top
+	}
+	return top.Add(netflow)
+}
+
+// Commit writes top rows of every bucket into sink. Rows of existing output,
+// like with opts.Merge, are added before top rows are chosen, so output keeps
+// top rows only. It writes buckets by pool of goroutines and reports errors of
+// every failed bucket at once.
+func (self *Approx) Commit(sink Sink) error {
+	timeIDs := make([]string, 0, len(self.buckets))
+	for timeID := range self.buckets {
+		timeIDs = append(timeIDs, timeID)
+	}
+	sort.Strings(timeIDs)
+
+	limit := self.limit / int64(self.writers)
+	return writeBuckets(timeIDs, self.writers, func(timeID string) error {
+		data := self.buckets[timeID].data()
+		rows := recordRows(SortOrder(SortKey).Sorted(data))
+		return self.out.writeBucket(sink, timeID, rows, limit)
+	})
+}
+
+// Close removes staging dir, if it was created
+func (self *Approx) Close() error {
+	return self.out.stage.Remove()
+}
+
+// newSpaceSaving returns initialized [*spaceSaving] for approximate top
+// opts.Approx rows. Rows grow on demand, so bucket with a few keys takes memory
+// for these keys only.
+func newSpaceSaving(opts *Options) *spaceSaving {
+	return &spaceSaving{
+		n:        approxFactor * opts.Approx,
+		order:    opts.TopBy.order(),
+		overflow: opts.Overflow,
+		errStart: len(opts.metrics()) - len(approxMetrics),
+		index:    make(map[string]int),
+	}
+}
+
+// spaceSaving keeps at most n rows of one bucket in min-heap by ranking
+// counter. Row of new key replaces the smallest row, when there is no room,
+// and inherits its counters, which become error bounds of the new row. So
+// every row with true counter larger than the smallest counter is kept.
+type spaceSaving struct {
+	n        int
+	order    SortOrder      // order of rows from the largest one
+	overflow Overflow       // what to do, when sum of counters overflows
+	errStart int            // index of PacketsError in metrics of rows
+	rows     []*CSVRecord   // min-heap, the smallest row is the root
+	index    map[string]int // index of row in rows by uniq ID
+}
+
+// Add adds counters of netflow to its row. If there is no such row, it adds new
+// row, replacing the smallest one, if there is no room.
+func (self *spaceSaving) Add(netflow *CSVRecord) error {
+	if i, present := self.index[netflow.ID]; present {
+		if err := self.overflow.check(self.rows[i].Add(netflow)); err != nil {
+			return err
+		}
+		heap.Fix(self, i)
+		return nil
+	}
+
+	// Keys can share memory with the whole input line, don't keep it.
+	for i, key := range netflow.Keys {
+		netflow.Keys[i] = strings.Clone(key)
+	}
+
+	if len(self.rows) < self.n {
+		heap.Push(self, netflow)
+		return nil
+	}
+
+	replaced := self.rows[0]
+	if err := self.overflow.check(netflow.Add(replaced)); err != nil {
+		return err
+	}
+	netflow.Metrics[self.errStart] = replaced.Packets
+	netflow.Metrics[self.errStart+1] = replaced.Bytes
+
+	delete(self.index, replaced.ID)
+	self.rows[0] = netflow
+	self.index[netflow.ID] = 0
+	heap.Fix(self, 0)
+	return nil
+}
+
+// data returns every kept row
+func (self *spaceSaving) data() HourData {
+	data := make(HourData, len(self.rows))
+	for _, netflow := range self.rows {
+		data[netflow.ID] = netflow
+	}
+	return data
+}
+
+func (self *spaceSaving) Len() int { return len(self.rows) }
+
+// Less makes the smallest row the root of heap
+func (self *spaceSaving) Less(i, j int) bool {
+	return self.order.less(self.rows[j], self.rows[i])
+}
+
+func (self *spaceSaving) Swap(i, j int) {
+	self.rows[i], self.rows[j] = self.rows[j], self.rows[i]
+	self.index[self.rows[i].ID] = i
+	self.index[self.rows[j].ID] = j
+}
+
+func (self *spaceSaving) Push(x any) {
+	row := x.(*CSVRecord)
+	self.index[row.ID] = len(self.rows)
+	self.rows = append(self.rows, row)
+}
+
+func (self *spaceSaving) Pop() any {
+	row := self.rows[len(self.rows)-1]
+	self.rows = self.rows[:len(self.rows)-1]
+	delete(self.index, row.ID)
+	return row
+}
@@ -0,0 +1,236 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeApproxRecords returns records of 2 buckets and 200 keys, interleaved.
+// The first 5 keys are heavy hitters, the rest ones have less bytes the larger
+// their num is.
+func makeApproxRecords(opts *Options) []*CSVRecord {
+	timeIDs := []string{"2017-04-26-11", "2017-04-26-10"}
+	var records []*CSVRecord
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 200; i++ {
+			for _, timeID := range timeIDs {
+				rec := &CSVRecord{
+					TimeID:  timeID,
+					Keys:    []string{fmt.Sprintf("10.0.0.%d", i), "TCP"},
+					Packets: 1,
+					Bytes:   uint64((200 - i) * (200 - i) / 10),
+				}
+				if i < 5 {
+					rec.Bytes = uint64(100000 - i)
+				}
+				rec.ID = rec.genUniqID()
+				rec.setMetrics(opts.metrics())
+				records = append(records, rec)
+			}
+		}
+	}
+	return records
+}
+
+func TestSpaceSaving(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Approx = 5
+
+	exact := make(HourData)
+	top := newSpaceSaving(opts)
+	var total uint64
+	for _, rec := range makeApproxRecords(opts) {
+		if rec.TimeID != "2017-04-26-10" {
+			continue
+		}
+		copied := *rec
+		copied.Metrics = append([]uint64(nil), rec.Metrics...)
+		require.NoError(exact.Add(&copied))
+		total += rec.Bytes
+		require.NoError(top.Add(rec))
+	}
+
+	data := top.data()
+	assert.Len(data, approxFactor*opts.Approx)
+
+	// Counters of every row are inherited, so the total is exact
+	var sum uint64
+	for id, netflow := range data {
+		sum += netflow.Bytes
+
+		want := exact[id]
+		require.NotNil(want)
+		errBytes, errPackets := netflow.Metrics[1], netflow.Metrics[0]
+		assert.LessOrEqual(want.Bytes, netflow.Bytes)
+		assert.GreaterOrEqual(want.Bytes, netflow.Bytes-errBytes)
+		assert.GreaterOrEqual(want.Packets, netflow.Packets-errPackets)
+	}
+	assert.Equal(total, sum)
+
+	rows := orderedRows(t, data, &Options{Top: opts.Approx})
+	require.Len(rows, opts.Approx)
+	for i, netflow := range rows {
+		assert.Equal("2017-04-26-10"+idSeparator+
+			fmt.Sprintf("10.0.0.%d", i)+idSeparator+"TCP", netflow.ID)
+	}
+}
+
+func TestApprox(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Approx = 3
+	opts.TopOther = true
+
+	approx := NewAggregator(t.TempDir(), 256<<20, 1, opts)
+	require.IsType(&Approx{}, approx)
+	totals := make(map[string]uint64)
+	for _, rec := range makeApproxRecords(opts) {
+		totals[rec.TimeID] += rec.Bytes
+		require.NoError(approx.Add(rec))
+	}
+
+	sink := newMemSink()
+	require.NoError(approx.Commit(sink))
+	require.NoError(approx.Close())
+	assert.Equal([]string{"2017-04-26-10", "2017-04-26-11"}, sink.timeIDs)
+
+	for timeID, data := range sink.data {
+		assert.Len(data, opts.Approx+1)
+
+		var sum uint64
+		for _, netflow := range data {
+			sum += netflow.Bytes
+		}
+		assert.Equal(totals[timeID], sum)
+	}
+}
+
+func TestApproxWorkers(t *testing.T) {
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Approx = 1
+
+	// Chunks are parsed in parallel, but their records are added in the same
+	// order every run and for any num of workers, so Space-Saving chooses the
+	// same rows.
+	input := makeParseInput(3*parseChunkSize + 100)
+	var want map[string]HourData
+	for _, workers := range []int{4, 4, 4, 1, 2, 0} {
+		badRows, err := NewBadRows(path.Join(t.TempDir(), "bad.csv"), 0)
+		require.NoError(err)
+		approx := NewAggregator(t.TempDir(), 256<<20, workers, opts)
+		require.NoError(ParseInput(strings.NewReader(input), "in.csv", opts,
+			workers, badRows, approx.Add))
+		require.NoError(badRows.Close())
+		sink := newMemSink()
+		require.NoError(approx.Commit(sink))
+		require.NoError(approx.Close())
+
+		if want == nil {
+			want = sink.data
+			continue
+		}
+		require.Equal(want, sink.data, workers)
+	}
+}
+
+func TestApproxMerge(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Approx = 3
+	opts.Merge = true
+
+	// The second run has other keys and adds its rows to rows of the first
+	// one, but output still keeps top rows only.
+	outDir := t.TempDir()
+	for _, prefix := range []string{"10.0.0.", "10.0.1."} {
+		approx := NewAggregator(t.TempDir(), 256<<20, 1, opts)
+		for _, rec := range makeApproxRecords(opts) {
+			rec.Keys[0] = strings.Replace(rec.Keys[0], "10.0.0.", prefix, 1)
+			rec.ID = rec.genUniqID()
+			require.NoError(approx.Add(rec))
+		}
+		require.NoError(approx.Commit(NewOutDir(outDir, t.TempDir(), opts)))
+		require.NoError(approx.Close())
+	}
+
+	for _, timeID := range []string{"2017-04-26-10", "2017-04-26-11"} {
+		data, err := loadHourFile(path.Join(outDir, timeID+".csv"), opts)
+		require.NoError(err)
+		assert.Len(data, opts.Approx, timeID)
+		for _, key := range []string{"10.0.0.0", "10.0.1.0", "10.0.0.1"} {
+			assert.Contains(data, timeID+idSeparator+key+idSeparator+"TCP")
+		}
+	}
+}
+
+func TestApproxFormats(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, format := range []string{FormatCSV, FormatJSONL, FormatParquet} {
+		opts := NewOptions()
+		opts.Approx = 1
+		require.NoError(opts.Format.Set(format))
+
+		rec := makeApproxRecords(opts)[0]
+		rec.Metrics[0], rec.Metrics[1] = 7, 11
+
+		b := new(bytes.Buffer)
+		w := NewRecordWriter(b, opts)
+		require.NoError(w.WriteHeader())
+		require.NoError(w.Write(rec))
+		require.NoError(w.Close())
+
+		r, err := NewRecordReader(b, opts)
+		require.NoError(err)
+		got, err := r.Read()
+		require.NoError(err)
+		require.NotNil(got, format)
+		assert.Equal(rec.ID, got.ID, format)
+		assert.Equal([]uint64{7, 11}, got.Metrics, format)
+	}
+}
+
+func TestApproxMetrics(t *testing.T) {
+	opts := NewOptions()
+	opts.Approx = 3
+	assert.NoError(t, opts.Check())
+
+	// Evicted row would pass its flows and durations to the new key
+	opts.Metrics = true
+	assert.Error(t, opts.Check())
+
+	opts.Approx = 0
+	assert.NoError(t, opts.Check())
+}
+
+func TestApproxLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := NewOptions()
+	opts.Approx = maxApprox
+	assert.NoError(opts.Check())
+	opts.Approx = maxApprox + 1
+	assert.Error(opts.Check())
+
+	// Huge N doesn't take memory until rows come
+	opts.Approx = maxApprox
+	top := newSpaceSaving(opts)
+	assert.Equal(approxFactor*maxApprox, top.n)
+	assert.Zero(cap(top.rows))
+}
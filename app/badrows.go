@@ -0,0 +1,152 @@
+package app
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Reasons of rejecting input lines
+const (
+	ReasonFieldCount   = "wrong field count"
+	ReasonMalformed    = "malformed line"
+	ReasonBadTimestamp = "bad timestamp"
+	ReasonBadCounter   = "bad counter"
+	ReasonBadDuration  = "bad duration"
+)
+
+// RowError reports a line of input, which can't be parsed. Other lines of input
+// still can be parsed.
+type RowError struct {
+	File   string   // name of input, if caller knows it
+	Line   int      // line number in input
+	Reason string   // why the line was rejected, like [ReasonBadTimestamp]
+	Record []string // fields of the line, if we were able to read them
+	Err    error    // the error, which caused rejecting
+}
+
+func (self *RowError) Error() string {
+	msg := fmt.Sprintf("line %d: %s: %v", self.Line, self.Reason, self.Err)
+	if self.File != "" {
+		return self.File + ": " + msg
+	}
+	return msg
+}
+
+func (self *RowError) Unwrap() error {
+	return self.Err
+}
+
+// newRowError returns [*RowError] for record, which is line number line of
+// input. It copies record, because reader can reuse it.
+func newRowError(
+	line int, record []string, reason string, err error,
+) *RowError {
+	return &RowError{
+		Line:   line,
+		Reason: reason,
+		Record: append([]string(nil), record...),
+		Err:    err,
+	}
+}
+
+// newReadError converts err returned by [csv.Reader.Read] into [*RowError], if
+// it's an error of one line only. Otherwise it returns err as is.
+func newReadError(err error, record []string) error {
+	var perr *csv.ParseError
+	if !errors.As(err, &perr) {
+		return err
+	}
+
+	reason := ReasonMalformed
+	if errors.Is(perr.Err, csv.ErrFieldCount) {
+		reason = ReasonFieldCount
+	}
+	return &RowError{
+		Line:   perr.StartLine,
+		Reason: reason,
+		Record: append([]string(nil), record...),
+		Err:    perr.Err,
+	}
+}
+
+// The header line of quarantine .csv file. Fields of rejected line follow
+// these columns.
+var badRowsHeader = []string{"File", "Line", "Reason", "Error"}
+
+// NewBadRows returns initialized [*BadRows]. If fname isn't empty, it creates
+// quarantine .csv file fname and writes every rejected line into it. If
+// maxErrors > 0, it allows to reject maxErrors lines at most. If fname is
+// empty, it doesn't allow to reject any line.
+func NewBadRows(fname string, maxErrors int) (*BadRows, error) {
+	bad := &BadRows{maxErrors: maxErrors}
+	if fname == "" {
+		return bad, nil
+	}
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	bad.f = f
+	bad.w = csv.NewWriter(f)
+	if err := bad.w.Write(badRowsHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return bad, nil
+}
+
+// BadRows writes rejected lines of input into quarantine .csv file and counts
+// them.
+type BadRows struct {
+	f         *os.File    // quarantine .csv file
+	w         *csv.Writer // writer of quarantine .csv file
+	count     int         // num of rejected lines
+	maxErrors int         // max num of rejected lines, 0 means no limit
+}
+
+// Reject writes line of err into quarantine .csv file, if err is [*RowError].
+// It returns err back, if it isn't [*RowError], or there is no quarantine file,
+// or there are too many rejected lines. Caller should stop processing of input
+// in this case.
+func (self *BadRows) Reject(err error) error {
+	var rowErr *RowError
+	if self.w == nil || !errors.As(err, &rowErr) {
+		return err
+	}
+
+	self.count++
+	if self.maxErrors > 0 && self.count > self.maxErrors {
+		return fmt.Errorf("too many bad rows (more than %d), last one: %w",
+			self.maxErrors, err)
+	}
+
+	record := make([]string, 0, len(rowErr.Record)+len(badRowsHeader))
+	record = append(record, rowErr.File,
+		strconv.Itoa(rowErr.Line), rowErr.Reason, rowErr.Err.Error())
+	record = append(record, rowErr.Record...)
+	if err := self.w.Write(record); err != nil {
+		return err
+	}
+	// Flush every line, so we don't lose them if caller stops processing
+	self.w.Flush()
+
+	return self.w.Error()
+}
+
+// Count returns num of rejected lines
+func (self *BadRows) Count() int {
+	return self.count
+}
+
+// Close closes quarantine .csv file
+func (self *BadRows) Close() error {
+	if self.f == nil {
+		return nil
+	}
+	return self.f.Close()
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBadRows(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fname := path.Join(t.TempDir(), "bad.csv")
+	bad, err := NewBadRows(fname, 2)
+	require.NoError(err)
+
+	rowErr := &RowError{
+		File:   "in.csv",
+		Line:   2,
+		Reason: ReasonBadCounter,
+		Record: []string{"a", "b"},
+		Err:    errors.New("oops"),
+	}
+	require.NoError(bad.Reject(rowErr))
+	require.NoError(bad.Reject(rowErr))
+	assert.Error(bad.Reject(rowErr))
+	assert.Equal(3, bad.Count())
+	assert.Equal("in.csv: line 2: bad counter: oops", rowErr.Error())
+
+	otherErr := errors.New("other")
+	assert.Equal(otherErr, bad.Reject(otherErr))
+	require.NoError(bad.Close())
+
+	f, err := os.Open(fname)
+	require.NoError(err)
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	require.NoError(err)
+	assert.Equal([][]string{
+		badRowsHeader,
+		{"in.csv", "2", ReasonBadCounter, "oops", "a", "b"},
+		{"in.csv", "2", ReasonBadCounter, "oops", "a", "b"},
+	}, records)
+}
+
+func TestBadRowsWithoutFile(t *testing.T) {
+	bad, err := NewBadRows("", 0)
+	require.NoError(t, err)
+	defer bad.Close()
+
+	rowErr := &RowError{Line: 2, Err: errors.New("oops")}
+	assert.Equal(t, rowErr, bad.Reject(rowErr))
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The bucket we use by default, it aggregates data by day-hour
+const defBucket = "1h"
+
+// Bucket defines time granularity of aggregation. Every timestamp is truncated
+// to the beginning of its bucket and formatted as time ID of that bucket. Time
+// IDs of the same bucket length always sort in time order.
+type Bucket struct {
+	name   string        // how the bucket was defined, like "5m" or "1d"
+	d      time.Duration // length of the bucket
+	layout string        // layout for formatting time ID
+}
+
+// ParseBucket parses bucket definition s and returns initialized [Bucket]. It
+// accepts any duration [time.ParseDuration] understands, like "5m" or "1h30m",
+// and also days and weeks, like "1d" or "2w". The bucket must be a multiple of
+// one second.
+func ParseBucket(s string) (Bucket, error) {
+	d, err := parseBucketDuration(s)
+	if err != nil {
+		return Bucket{}, fmt.Errorf("invalid bucket %q: %w", s, err)
+	} else if d <= 0 || d%time.Second != 0 {
+		return Bucket{}, fmt.Errorf(
+			"invalid bucket %q: must be a positive multiple of 1s", s)
+	}
+
+	return Bucket{name: s, d: d, layout: bucketLayout(d)}, nil
+}
+
+// parseBucketDuration converts s into time.Duration. In addition to
+// [time.ParseDuration] it understands "d" (days) and "w" (weeks) suffixes.
+func parseBucketDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if num := strings.TrimSuffix(s, suffix); num != s {
+			n, err := strconv.ParseUint(num, 10, 16)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+
+	return time.ParseDuration(s)
+}
+
+// bucketLayout returns the shortest layout of time ID, which still can
+// distinguish buckets of length d.
+func bucketLayout(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return "2006-01-02"
+	case d%time.Hour == 0:
+		return "2006-01-02-15"
+	case d%time.Minute == 0:
+		return "2006-01-02-15-04"
+	}
+	return "2006-01-02-15-04-05"
+}
+
+// TimeID returns time ID of the bucket t belongs to. Buckets are aligned to
+// zero time, so weekly buckets begin on Monday.
+func (self Bucket) TimeID(t time.Time) string {
+	return t.Truncate(self.d).Format(self.layout)
+}
+
+// ParseTimeID returns beginning of the bucket with time ID s
+func (self Bucket) ParseTimeID(s string) (time.Time, error) {
+	return time.Parse(self.layout, s)
+}
+
+// String returns definition of the bucket. It implements [flag.Value].
+func (self *Bucket) String() string {
+	return self.name
+}
+
+// Set parses s and assigns the result to the bucket. It implements
+// [flag.Value].
+func (self *Bucket) Set(s string) error {
+	b, err := ParseBucket(s)
+	if err != nil {
+		return err
+	}
+	*self = b
+	return nil
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBucket(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tests := map[string]struct {
+		d      time.Duration
+		layout string
+	}{
+		"1m":  {time.Minute, "2006-01-02-15-04"},
+		"5m":  {5 * time.Minute, "2006-01-02-15-04"},
+		"15m": {15 * time.Minute, "2006-01-02-15-04"},
+		"1h":  {time.Hour, "2006-01-02-15"},
+		"90m": {90 * time.Minute, "2006-01-02-15-04"},
+		"1d":  {24 * time.Hour, "2006-01-02"},
+		"1w":  {7 * 24 * time.Hour, "2006-01-02"},
+		"30s": {30 * time.Second, "2006-01-02-15-04-05"},
+	}
+	for s, want := range tests {
+		b, err := ParseBucket(s)
+		require.NoError(err, s)
+		assert.Equal(want.d, b.d, s)
+		assert.Equal(want.layout, b.layout, s)
+		assert.Equal(s, b.String())
+	}
+
+	for _, s := range []string{"", "0", "-1h", "1ms", "1.5d", "xd", "foo"} {
+		_, err := ParseBucket(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestBucketTimeID(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := time.Date(2017, 4, 26, 11, 11, 17, 0, time.UTC)
+	tests := map[string]string{
+		"1m":  "2017-04-26-11-11",
+		"5m":  "2017-04-26-11-10",
+		"15m": "2017-04-26-11-00",
+		"1h":  "2017-04-26-11",
+		"1d":  "2017-04-26",
+		"1w":  "2017-04-24", // Monday
+	}
+	for s, want := range tests {
+		var b Bucket
+		assert.NoError(b.Set(s))
+		assert.Equal(want, b.TimeID(ts), s)
+	}
+}
+
+func TestNewRecordBucket(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	require.NoError(opts.Bucket.Set("1d"))
+
+	r := csv.NewReader(strings.NewReader(testRecord2))
+	h, err := NewHeader(r)
+	require.NoError(err)
+
+	rec, err := NewRecord(h, r, opts)
+	require.NoError(err)
+	assert.Equal("2017-04-26", rec.TimeID)
+}
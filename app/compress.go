@@ -0,0 +1,74 @@
+package app
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of output files
+const (
+	CompressNone = ""
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// compressExts maps compression algorithm to extension of compressed files
+var compressExts = map[string]string{
+	CompressNone: "",
+	CompressGzip: ".gz",
+	CompressZstd: ".zst",
+}
+
+// Compression defines how we compress output files. Zero value means no
+// compression.
+type Compression string
+
+// String returns name of compression algorithm. It implements [flag.Value].
+func (self *Compression) String() string {
+	return string(*self)
+}
+
+// Set checks s is a known compression algorithm and assigns it. "none" means
+// no compression. It implements [flag.Value].
+func (self *Compression) Set(s string) error {
+	if s == "none" {
+		s = CompressNone
+	}
+	if _, present := compressExts[s]; !present {
+		return fmt.Errorf("unknown compression %q, expected none, %s or %s",
+			s, CompressGzip, CompressZstd)
+	}
+	*self = Compression(s)
+	return nil
+}
+
+// Ext returns extension of files compressed by this algorithm, like ".gz"
+func (self Compression) Ext() string {
+	return compressExts[string(self)]
+}
+
+// NewWriter returns writer, which compresses data and writes it into w. Caller
+// must close it to flush compressed data. Closing doesn't close w. Compressed
+// stream is complete after closing, so we can append another one to the same
+// file and decompress them as one stream later.
+func (self Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch self {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// nopWriteCloser is like [io.NopCloser], but for writers
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,20 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionSet(t *testing.T) {
+	assert := assert.New(t)
+
+	var c Compression
+	assert.NoError(c.Set("gzip"))
+	assert.Equal(".gz", c.Ext())
+	assert.NoError(c.Set("zstd"))
+	assert.Equal(".zst", c.Ext())
+	assert.NoError(c.Set("none"))
+	assert.Equal("", c.Ext())
+	assert.Error(c.Set("lz4"))
+}
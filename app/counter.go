@@ -0,0 +1,172 @@
+package app
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// Errors of parsing counters in addition to [strconv.ErrSyntax] and
+// [strconv.ErrRange].
+var (
+	errNegativeCounter   = errors.New("negative value")
+	errFractionalCounter = errors.New("fractional value")
+)
+
+// maxUint64Digits is num of decimal digits of math.MaxUint64
+const maxUint64Digits = 20
+
+// parseCounter converts counter s from text to uint64. Plain digits, like
+// "300000", take the fast path. It also understands decimal and scientific
+// notation, like "3e+05" or "300000.0", and converts them exactly. It returns
+// an error, if s isn't a number, or it's negative, or it has non-zero
+// fractional part, or it doesn't fit into uint64. It doesn't allocate memory.
+func parseCounter(s string) (uint64, error) {
+	if n, ok := parseDigits(s); ok {
+		return n, nil
+	}
+	return parseCounterSlow(s)
+}
+
+// parseDigits converts s, which must contain decimal digits only, into uint64.
+// It returns false if s contains anything else or it's too long, so it doesn't
+// fit into uint64 for sure.
+func parseDigits(s string) (uint64, bool) {
+	if s == "" || len(s) >= maxUint64Digits {
+		return 0, false
+	}
+
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		c := s[i] - '0'
+		if c > 9 {
+			return 0, false
+		}
+		n = n*10 + uint64(c)
+	}
+	return n, true
+}
+
+// parseCounterSlow converts s like [parseCounter], but it accepts sign,
+// decimal point and exponent. It represents s as significant digits D and
+// exponent E, so value of s is D * 10^E, and D has no trailing zeros. Then
+// E < 0 means fractional value.
+func parseCounterSlow(s string) (uint64, error) {
+	i := 0
+	neg := false
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		neg = s[i] == '-'
+		i++
+	}
+
+	// Mantissa is digits with optional decimal point. first and last are
+	// positions of the first and last significant digits, leading zeros are
+	// not significant.
+	first, last := -1, -1
+	fracDigits := 0 // num of digits after decimal point
+	sawDigit, sawPoint := false, false
+	for ; i < len(s); i++ {
+		if c := s[i]; c >= '0' && c <= '9' {
+			sawDigit = true
+			if sawPoint {
+				fracDigits++
+			}
+			if first < 0 && c != '0' {
+				first = i
+			}
+			last = i
+		} else if c == '.' && !sawPoint {
+			sawPoint = true
+		} else {
+			break
+		}
+	}
+	if !sawDigit {
+		return 0, strconv.ErrSyntax
+	}
+
+	exp, err := parseExponent(s, i)
+	if err != nil {
+		return 0, err
+	}
+
+	if first < 0 {
+		// All digits are zeros
+		return 0, nil
+	} else if neg {
+		return 0, errNegativeCounter
+	}
+
+	// Drop trailing zeros, every dropped zero multiplies D by 10.
+	exp -= fracDigits
+	for s[last] == '0' || s[last] == '.' {
+		if s[last] == '0' {
+			exp++
+		}
+		last--
+	}
+	if exp < 0 {
+		return 0, errFractionalCounter
+	}
+
+	var n uint64
+	ok := true
+	for j := first; j <= last && ok; j++ {
+		if s[j] != '.' {
+			n, ok = mulAdd(n, 10, uint64(s[j]-'0'))
+		}
+	}
+	for ; exp > 0 && ok; exp-- {
+		n, ok = mulAdd(n, 10, 0)
+	}
+	if !ok {
+		return 0, strconv.ErrRange
+	}
+
+	return n, nil
+}
+
+// parseExponent parses optional exponent of s, like "e+05", beginning at
+// position i. It returns the exponent and checks nothing follows it.
+func parseExponent(s string, i int) (int, error) {
+	if i == len(s) {
+		return 0, nil
+	} else if s[i] != 'e' && s[i] != 'E' {
+		return 0, strconv.ErrSyntax
+	}
+	i++
+
+	neg := false
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		neg = s[i] == '-'
+		i++
+	}
+	if i == len(s) {
+		return 0, strconv.ErrSyntax
+	}
+
+	exp := 0
+	for ; i < len(s); i++ {
+		c := s[i] - '0'
+		if c > 9 {
+			return 0, strconv.ErrSyntax
+		}
+		// Such exponent is out of range anyway, just don't overflow int
+		if exp < math.MaxInt32 {
+			exp = exp*10 + int(c)
+		}
+	}
+	if neg {
+		exp = -exp
+	}
+
+	return exp, nil
+}
+
+// mulAdd returns n*m + a and false if it overflows uint64
+func mulAdd(n, m, a uint64) (uint64, bool) {
+	hi, lo := bits.Mul64(n, m)
+	sum, carry := bits.Add64(lo, a, 0)
+	return sum, hi == 0 && carry == 0
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCounter(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		s   string
+		n   uint64
+		err error
+	}{
+		{"0", 0, nil},
+		{"300000", 300000, nil},
+		{"3e+05", 300000, nil},
+		{"3E5", 300000, nil},
+		{"300000.0", 300000, nil},
+		{"3.5e1", 35, nil},
+		{"120e-1", 12, nil},
+		{"0.0", 0, nil},
+		{"-0", 0, nil},
+		{"+7", 7, nil},
+		{"7.", 7, nil},
+		{"000123", 123, nil},
+		{"1e-999999999999", 0, errFractionalCounter},
+		{"0e999999999999", 0, nil},
+		{"9999999999999999999", 9999999999999999999, nil},
+		{"18446744073709551615", 18446744073709551615, nil},
+		{"1.8446744073709551615e19", 18446744073709551615, nil},
+		{"18446744073709551616", 0, strconv.ErrRange},
+		{"1e20", 0, strconv.ErrRange},
+		{"1e999999999999", 0, strconv.ErrRange},
+		{"1.5", 0, errFractionalCounter},
+		{"12e-1", 0, errFractionalCounter},
+		{".5", 0, errFractionalCounter},
+		{"-1", 0, errNegativeCounter},
+		{"-3e5", 0, errNegativeCounter},
+		{"", 0, strconv.ErrSyntax},
+		{"x", 0, strconv.ErrSyntax},
+		{".", 0, strconv.ErrSyntax},
+		{"1e", 0, strconv.ErrSyntax},
+		{"1e+", 0, strconv.ErrSyntax},
+		{"1x", 0, strconv.ErrSyntax},
+		{"1.2.3", 0, strconv.ErrSyntax},
+		{" 1", 0, strconv.ErrSyntax},
+		{"Inf", 0, strconv.ErrSyntax},
+		{"NaN", 0, strconv.ErrSyntax},
+	}
+
+	for _, tt := range tests {
+		n, err := parseCounter(tt.s)
+		assert.Equal(tt.n, n, tt.s)
+		assert.ErrorIs(err, tt.err, tt.s)
+	}
+}
+
+func TestParseCounterAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, s := range []string{"300000", "3e+05", "1.5", "x"} {
+			_, _ = parseCounter(s)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+// benchCounters are typical counters of input, mostly plain digits
+var benchCounters = []string{"0", "1", "22", "132", "110414", "3e+05", "55"}
+
+func BenchmarkParseCounter(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, s := range benchCounters {
+			if _, err := parseCounter(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkParseCounterBigFloat measures previous implementation of
+// extractCounter for comparison.
+func BenchmarkParseCounterBigFloat(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, s := range benchCounters {
+			v, _, err := big.ParseFloat(s, 10, 0, big.ToNearestEven)
+			if err != nil {
+				b.Fatal(err)
+			}
+			v.Uint64()
+		}
+	}
+}
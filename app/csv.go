@@ -2,162 +2,420 @@ package app
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"math/big"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// The header line our output .csv files
-var outHeaderRecord = []string{
-	"Timestamp",
-	"Destination.IP",
-	"ProtocolName",
-	"Packets",
-	"Bytes",
+// outHeaderRecord returns the header line of our output .csv files. It contains
+// Timestamp, every column of opts.GroupBy, counters and metrics opts want.
+func outHeaderRecord(opts *Options) []string {
+	metrics := opts.metrics()
+	header := make([]string, 0, len(opts.GroupBy)+3+len(metrics))
+	header = append(header, "Timestamp")
+	header = append(header, opts.GroupBy...)
+	header = append(header, "Packets", "Bytes")
+	header = append(header, metricNames(metrics)...)
+	return header
 }
 
-// NewHeader reads CSV header line from r and returns initialized [csvHeader]
-func NewHeader(r *csv.Reader) (CSVHeader, error) {
+// idSeparator separates parts of uniq ID of aggregation. It's unlikely to meet
+// it in .csv, so different keys can't produce the same ID.
+const idSeparator = "\x00"
+
+// NewHeader reads CSV header line from r and returns initialized [csvHeader].
+// It checks every column of required exists in the header exactly once and
+// reports all missing and duplicate columns at once by [*HeaderError].
+func NewHeader(r *csv.Reader, required ...string) (CSVHeader, error) {
 	record, err := r.Read()
 	if err != nil {
 		return nil, err
 	}
 
-	header := make(CSVHeader, len(record))
-	for i := 0; i < len(record); i++ {
-		header[record[i]] = i
+	header := newCSVHeader(record)
+
+	if err := header.validate(record, required); err != nil {
+		return nil, err
 	}
 
 	return header, nil
 }
 
+// NewInputHeader reads header line of input .csv from r. If opts.Schema isn't
+// set, it detects schema of the input. It checks the header has every column
+// opts require and returns the header and copy of opts for this input, which
+// should be used for parsing of its lines.
+func NewInputHeader(r *csv.Reader, opts *Options) (CSVHeader, *Options, error) {
+	record, err := r.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := newCSVHeader(record)
+
+	opts, err = opts.forInput(header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := header.validate(record, opts.requiredColumns()); err != nil {
+		return nil, nil, err
+	}
+
+	return header, opts, nil
+}
+
+// NewCompactHeader is a light version of [NewInputHeader]. It reads header line
+// of our intermediate .csv file, written by [WriteCSVHeader] with the same opts,
+// and checks it has every column we wrote.
+func NewCompactHeader(r *csv.Reader, opts *Options) (CSVHeader, error) {
+	return NewHeader(r, outHeaderRecord(opts)...)
+}
+
+// HeaderError reports every missing and duplicate column of header line
+type HeaderError struct {
+	Missing   []string // required columns, which don't exist
+	Duplicate []string // required columns, which exist more than once
+}
+
+func (self *HeaderError) Error() string {
+	var problems []string
+	if len(self.Missing) > 0 {
+		problems = append(problems,
+			"missing columns: "+strings.Join(self.Missing, ", "))
+	}
+	if len(self.Duplicate) > 0 {
+		problems = append(problems,
+			"duplicate columns: "+strings.Join(self.Duplicate, ", "))
+	}
+	return "invalid header: " + strings.Join(problems, "; ")
+}
+
 // CSVHeader keeps column number (or field index) for every field of .csv
 // file. Using it we can map field name to index of value of that field.
 type CSVHeader map[string]int
 
-// extractField returns value for field from record
+// newCSVHeader returns [CSVHeader] for header line record
+func newCSVHeader(record []string) CSVHeader {
+	header := make(CSVHeader, len(record))
+	for i := 0; i < len(record); i++ {
+		header[record[i]] = i
+	}
+	return header
+}
+
+// validate checks every column of required exists in the header line record
+// exactly once.
+func (self CSVHeader) validate(record []string, required []string) error {
+	counts := make(map[string]int, len(record))
+	for _, col := range record {
+		counts[col]++
+	}
+
+	herr := new(HeaderError)
+	for _, col := range required {
+		switch counts[col] {
+		case 0:
+			herr.Missing = append(herr.Missing, col)
+		case 1:
+		default:
+			herr.Duplicate = append(herr.Duplicate, col)
+		}
+	}
+
+	if len(herr.Missing) > 0 || len(herr.Duplicate) > 0 {
+		return herr
+	}
+	return nil
+}
+
+// extractField returns value for field from record. It returns empty string if
+// there is no such field.
 func (self CSVHeader) extractField(field string, record []string) string {
-	idx := self[field]
+	idx, present := self[field]
+	if !present {
+		return ""
+	}
 	return record[idx]
 }
 
 // NewRecord parses line from csv file r according to its header h and returns
-// it as [*csvRecord]. It extracts values for
+// it as [*csvRecord]. It aggregates timestamps by opts.Bucket. Using
+// opts.Schema it extracts values for
+//
+//   * timestamp
+//   * every column of opts.GroupBy, Destination.IP and ProtocolName by default
+//   * fwd_packets + bwd_packets
+//   * fwd_bytes + bwd_bytes
+//   * duration, if opts want metrics
+//   * every counter separately, if opts want directional counters
 //
-//   * Timestamp
-//   * Destination.IP
-//   * ProtocolName
-//   * Total.Fwd.Packets + Total.Backward.Packets
-//   * Total.Length.of.Fwd.Packets + Total.Length.of.Bwd.Packets
+// For CICFlowMeter I suppose Total.Fwd.Packets + Total.Backward.Packets is num
+// of packets in this line and Total.Length.of.Fwd.Packets +
+// Total.Length.of.Bwd.Packets is num of bytes.
 //
-// I suppose Total.Fwd.Packets + Total.Backward.Packets is num of packets in
-// this line and Total.Length.of.Fwd.Packets + Total.Length.of.Bwd.Packets is
-// num of bytes.
-func NewRecord(h CSVHeader, r *csv.Reader) (*CSVRecord, error) {
+// If the line can't be parsed, it returns [*RowError] and next call of NewRecord
+// continues with the next line.
+func NewRecord(h CSVHeader, r *csv.Reader, opts *Options) (*CSVRecord, error) {
 	record, err := r.Read()
 	if err == io.EOF {
 		return nil, nil
 	} else if err != nil {
-		return nil, err
+		return nil, newReadError(err, record)
 	}
 
-	rec := &CSVRecord{
-		h:         h,
-		DstIP:     h.extractField("Destination.IP", record),
-		ProtoName: h.extractField("ProtocolName", record),
-	}
-	rec.fillID(record)
+	line, _ := r.FieldPos(0)
+	return ParseRecord(h, record, line, opts)
+}
 
-	packets, err := rec.extractCounters(
-		record, "Total.Fwd.Packets", "Total.Backward.Packets")
+// ParseRecord parses fields of input line record like [NewRecord] does. line is
+// line number of record in input, it's used for reporting of errors. It doesn't
+// keep record, but keeps its strings.
+func ParseRecord(
+	h CSVHeader, record []string, line int, opts *Options,
+) (*CSVRecord, error) {
+	schema := opts.schema()
+	rec := &CSVRecord{h: h}
+	t, err := rec.fillID(record, opts)
 	if err != nil {
-		return nil, err
+		return nil, newRowError(line, record, ReasonBadTimestamp, err)
+	}
+
+	packets, err := rec.extractCounters(record,
+		schema.Column(FieldFwdPackets), schema.Column(FieldBwdPackets))
+	if err := opts.Overflow.check(err); err != nil {
+		return nil, newRowError(line, record, ReasonBadCounter, err)
 	}
 	rec.Packets = packets
 
-	bytes, err := rec.extractCounters(
-		record, "Total.Length.of.Fwd.Packets", "Total.Length.of.Bwd.Packets")
-	if err != nil {
-		return nil, err
+	bytes, err := rec.extractCounters(record,
+		schema.Column(FieldFwdBytes), schema.Column(FieldBwdBytes))
+	if err := opts.Overflow.check(err); err != nil {
+		return nil, newRowError(line, record, ReasonBadCounter, err)
 	}
 	rec.Bytes = bytes
 
+	rec.setMetrics(opts.metrics())
+	if err := rec.fillMetrics(record, t, opts); err != nil {
+		return nil, newRowError(line, record, ReasonBadDuration, err)
+	}
+
 	return rec, nil
 }
 
-// CSVRecord keeps data for one flow aggregated by day-hour, dst IP and proto
-// name. It keeps num of packets and bytes.
+// CSVRecord keeps data for one flow aggregated by day-hour and group-by key,
+// dst IP and proto name by default. It keeps num of packets and bytes and
+// values of additional metrics, if options want them.
 type CSVRecord struct {
-	h         CSVHeader
-	TimeID    string // day-hour ID
-	ID        string // uniq ID for this aggregation
-	DstIP     string // destination IP
-	ProtoName string // high level protocol name
-	Packets   uint64 // num of packets
-	Bytes     uint64 // num of bytes
-}
-
-// fillID extracts and assigns timeID, dstIP amd protoName. Using them is
-// generates uniq id for this flow.
-func (self *CSVRecord) fillID(record []string) error {
-	t, err := time.Parse("2/01/200615:04:05", self.h.extractField("Timestamp", record))
+	h       CSVHeader
+	TimeID  string   // time ID of the bucket, day-hour ID by default
+	ID      string   // uniq ID for this aggregation
+	Keys    []string // values of group-by columns
+	Packets uint64   // num of packets
+	Bytes   uint64   // num of bytes
+	Metrics []uint64 // values of metrics in order of output columns
+	metrics []metric // definitions of Metrics
+}
+
+// fillID extracts and assigns timeID and values of opts.GroupBy columns. Using
+// them is generates uniq id for this flow. timeID is the time ID of bucket. It
+// returns timestamp of the flow.
+func (self *CSVRecord) fillID(record []string, opts *Options) (time.Time, error) {
+	schema := opts.schema()
+	t, err := schema.ParseTime(
+		self.h.extractField(schema.Column(FieldTimestamp), record))
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 
-	self.TimeID = t.Format("2006-01-02-15")
-	self.DstIP = self.h.extractField("Destination.IP", record)
-	self.ProtoName = self.h.extractField("ProtocolName", record)
+	self.TimeID = opts.Bucket.TimeID(t)
+	self.fillKeys(record, opts.GroupBy, schema.Column)
 	self.ID = self.genUniqID()
 
+	return t, nil
+}
+
+// fillMetrics extracts and assigns values of metrics of this flow from record.
+// t is timestamp of the flow. Counters must be assigned already.
+func (self *CSVRecord) fillMetrics(
+	record []string, t time.Time, opts *Options,
+) error {
+	schema := opts.schema()
+	var duration uint64
+	if opts.Metrics {
+		col := schema.Column(FieldDuration)
+		s := self.h.extractField(col, record)
+		var err error
+		if duration, err = schema.ParseDuration(s); err != nil {
+			return fmt.Errorf("%s=%q: %w", col, s, err)
+		}
+	}
+
+	for i, m := range self.metrics {
+		switch m.name {
+		case metricFwdPackets:
+			self.Metrics[i] = self.directional(record, schema, FieldFwdPackets)
+		case metricBwdPackets:
+			self.Metrics[i] = self.directional(record, schema, FieldBwdPackets)
+		case metricFwdBytes:
+			self.Metrics[i] = self.directional(record, schema, FieldFwdBytes)
+		case metricBwdBytes:
+			self.Metrics[i] = self.directional(record, schema, FieldBwdBytes)
+		case metricFlows:
+			self.Metrics[i] = 1
+		case metricDurationMin, metricDurationMax, metricDurationSum:
+			self.Metrics[i] = duration
+		case metricFirstSeen, metricLastSeen:
+			self.Metrics[i] = uint64(max(t.UnixMicro(), 0))
+		}
+	}
+	self.updateDerived()
+
 	return nil
 }
 
-// genUniqID generates uniq ID based on values of timeID, dstIP and protoName
+// fillKeys extracts and assigns values of columns from record. column maps
+// every column to its name in record.
+func (self *CSVRecord) fillKeys(
+	record []string, columns []string, column func(string) string,
+) {
+	self.Keys = make([]string, len(columns))
+	for i, col := range columns {
+		self.Keys[i] = self.h.extractField(column(col), record)
+	}
+}
+
+// genUniqID generates uniq ID based on values of timeID and keys
 func (self *CSVRecord) genUniqID() string {
-	return fmt.Sprintf("%s-%s-%s", self.TimeID, self.DstIP, self.ProtoName)
+	var b strings.Builder
+	b.WriteString(self.TimeID)
+	for _, key := range self.Keys {
+		b.WriteString(idSeparator)
+		b.WriteString(key)
+	}
+	return b.String()
 }
 
 // extractCounters returns sum of values of fields f1 and f2 from record. It
-// converts them from text to uint64 before adding.
+// converts them from text to uint64 before adding. If a value or the sum
+// overflows, it returns saturated sum and [ErrCounterOverflow].
 func (self *CSVRecord) extractCounters(
 	record []string, f1 string, f2 string,
 ) (uint64, error) {
-	// strconv.ParseUint() can't parse "3e+05", use big.ParseFloat() instead.
-	fwdF, _, err := big.ParseFloat(
-		self.h.extractField(f1, record), 10, 0, big.ToNearestEven)
-	if err != nil {
-		return 0, err
+	fwd, fwdErr := self.extractCounter(record, f1)
+	if fwdErr != nil && !errors.Is(fwdErr, ErrCounterOverflow) {
+		return 0, fwdErr
 	}
-	fwd, _ := fwdF.Uint64()
 
-	backF, _, err := big.ParseFloat(
-		self.h.extractField(f2, record), 10, 0, big.ToNearestEven)
-	if err != nil {
-		return 0, err
+	back, backErr := self.extractCounter(record, f2)
+	if backErr != nil && !errors.Is(backErr, ErrCounterOverflow) {
+		return 0, backErr
 	}
-	back, _ := backF.Uint64()
 
-	return fwd + back, nil
+	sum, ok := addCounters(fwd, back)
+	switch {
+	case fwdErr != nil:
+		return sum, fwdErr
+	case backErr != nil:
+		return sum, backErr
+	case !ok:
+		return sum, fmt.Errorf("%w: %s + %s", ErrCounterOverflow, f1, f2)
+	}
+	return sum, nil
 }
 
-func (self *CSVRecord) Add(netflow *CSVRecord) {
-	self.Bytes += netflow.Bytes
-	self.Packets += netflow.Packets
+// directional returns value of counter field of one direction from record
+func (self *CSVRecord) directional(
+	record []string, schema *Schema, field string,
+) uint64 {
+	// It's parsed successfully already as a part of sum of directions
+	n, _ := self.extractCounter(record, schema.Column(field))
+	return n
 }
 
-// writeCSV writes internal data as line of CSV into w
-func (self *CSVRecord) WriteCSV(w *csv.Writer) error {
-	record := []string{
-		self.TimeID,
-		self.DstIP,
-		self.ProtoName,
+// extractCounter returns value of field f from record, converted to uint64. If
+// there is no such field, it returns 0. It's possible in lenient mode only,
+// because otherwise [NewInputHeader] doesn't accept such header. If the value
+// doesn't fit into uint64, it returns saturated value and
+// [ErrCounterOverflow].
+func (self *CSVRecord) extractCounter(record []string, f string) (uint64, error) {
+	if _, present := self.h[f]; !present {
+		return 0, nil
+	}
+
+	// strconv.ParseUint() can't parse "3e+05", use parseCounter() instead.
+	s := self.h.extractField(f, record)
+	n, err := parseCounter(s)
+	if errors.Is(err, strconv.ErrRange) {
+		return math.MaxUint64, fmt.Errorf("%w: %s=%q", ErrCounterOverflow, f, s)
+	} else if err != nil {
+		return 0, fmt.Errorf("%s=%q: %w", f, s, err)
+	}
+
+	return n, nil
+}
+
+// Add adds bytes and packets of netflow to this record and aggregates its
+// metrics. If a sum overflows, it saturates the counter and returns
+// [ErrCounterOverflow].
+func (self *CSVRecord) Add(netflow *CSVRecord) error {
+	var bytesOK, packetsOK bool
+	self.Bytes, bytesOK = addCounters(self.Bytes, netflow.Bytes)
+	self.Packets, packetsOK = addCounters(self.Packets, netflow.Packets)
+
+	// Every metric is aggregated even after overflow, so saturated record
+	// still has the rest data right.
+	overflowed := ""
+	for i, m := range self.metrics {
+		var ok bool
+		self.Metrics[i], ok = m.agg.apply(self.Metrics[i], netflow.Metrics[i])
+		if !ok && overflowed == "" {
+			overflowed = m.name
+		}
+	}
+	self.updateDerived()
+
+	switch {
+	case !bytesOK:
+		overflowed = "Bytes"
+	case !packetsOK:
+		overflowed = "Packets"
+	}
+	if overflowed != "" {
+		return fmt.Errorf("%w: %s of %s", ErrCounterOverflow, overflowed,
+			self.key())
+	}
+	return nil
+}
+
+// key returns human readable time ID and values of group-by columns
+func (self *CSVRecord) key() string {
+	return strings.Join(append([]string{self.TimeID}, self.Keys...), ",")
+}
+
+// outRecord returns internal data as fields of output line. Their order is the
+// same as order of [outHeaderRecord].
+func (self *CSVRecord) outRecord() []string {
+	record := make([]string, 0, len(self.Keys)+3+len(self.Metrics))
+	record = append(record, self.TimeID)
+	record = append(record, self.Keys...)
+	record = append(record,
 		strconv.FormatUint(self.Packets, 10),
 		strconv.FormatUint(self.Bytes, 10),
+	)
+	for _, n := range self.Metrics {
+		record = append(record, strconv.FormatUint(n, 10))
 	}
-	if err := w.Write(record); err != nil {
+	return record
+}
+
+// writeCSV writes internal data as line of CSV into w
+func (self *CSVRecord) WriteCSV(w *csv.Writer) error {
+	if err := w.Write(self.outRecord()); err != nil {
 		return err
 	}
 
@@ -165,8 +423,8 @@ func (self *CSVRecord) WriteCSV(w *csv.Writer) error {
 }
 
 // WriteCSVHeader writes [outHeaderRecord] as header line of CSV into w
-func WriteCSVHeader(w *csv.Writer) error {
-	if err := w.Write(outHeaderRecord); err != nil {
+func WriteCSVHeader(w *csv.Writer, opts *Options) error {
+	if err := w.Write(outHeaderRecord(opts)); err != nil {
 		return err
 	}
 	return nil
@@ -175,8 +433,10 @@ func WriteCSVHeader(w *csv.Writer) error {
 // NewRecordCompact is a light verion of [newRecord]. It parses line from our
 // intemediate csv file r according to its header h and returns it as
 // [*csvRecord]. It's simplier, because it actualy reads back output of
-// [writeCSV].
-func NewRecordCompact(h CSVHeader, r *csv.Reader) (*CSVRecord, error) {
+// [writeCSV] with the same opts.
+func NewRecordCompact(
+	h CSVHeader, r *csv.Reader, opts *Options,
+) (*CSVRecord, error) {
 	record, err := r.Read()
 	if err == io.EOF {
 		return nil, nil
@@ -185,11 +445,11 @@ func NewRecordCompact(h CSVHeader, r *csv.Reader) (*CSVRecord, error) {
 	}
 
 	rec := &CSVRecord{
-		h:         h,
-		TimeID:    h.extractField("Timestamp", record),
-		DstIP:     h.extractField("Destination.IP", record),
-		ProtoName: h.extractField("ProtocolName", record),
+		h:      h,
+		TimeID: h.extractField("Timestamp", record),
 	}
+	// Our output has columns named exactly like group-by columns
+	rec.fillKeys(record, opts.GroupBy, func(col string) string { return col })
 	rec.ID = rec.genUniqID()
 
 	// We can use ParseUint here, because we can be sure, we never meet "3e+05"
@@ -207,5 +467,14 @@ func NewRecordCompact(h CSVHeader, r *csv.Reader) (*CSVRecord, error) {
 	}
 	rec.Bytes = bytes
 
+	rec.setMetrics(opts.metrics())
+	for i, m := range rec.metrics {
+		n, err := strconv.ParseUint(h.extractField(m.name, record), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		rec.Metrics[i] = n
+	}
+
 	return rec, nil
 }
@@ -37,6 +37,62 @@ func TestNewHeader(t *testing.T) {
 	assert.Equal(h, want)
 }
 
+func TestNewHeaderRequired(t *testing.T) {
+	r := csv.NewReader(strings.NewReader("A,B,A,C"))
+	_, err := NewHeader(r, "A", "B", "D", "E")
+
+	var herr *HeaderError
+	require.ErrorAs(t, err, &herr)
+	assert.Equal(t, []string{"D", "E"}, herr.Missing)
+	assert.Equal(t, []string{"A"}, herr.Duplicate)
+	assert.Equal(t,
+		"invalid header: missing columns: D, E; duplicate columns: A",
+		herr.Error())
+
+	r = csv.NewReader(strings.NewReader("A,B,A,C"))
+	_, err = NewHeader(r, "B", "C")
+	assert.NoError(t, err)
+}
+
+func TestNewInputHeader(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Schema = DefaultSchema()
+	input := `Timestamp,Destination.IP,ProtocolName,Total.Fwd.Packets,Total.Length.of.Fwd.Packets
+26/04/201711:11:17,172.19.1.46,HTTP_PROXY,22,132`
+
+	r := csv.NewReader(strings.NewReader(input))
+	_, _, err := NewInputHeader(r, opts)
+	var herr *HeaderError
+	require.ErrorAs(err, &herr)
+	assert.Equal([]string{"Total.Backward.Packets", "Total.Length.of.Bwd.Packets"},
+		herr.Missing)
+
+	opts.Lenient = true
+	r = csv.NewReader(strings.NewReader(input))
+	h, opts, err := NewInputHeader(r, opts)
+	require.NoError(err)
+	rec, err := NewRecord(h, r, opts)
+	require.NoError(err)
+	assert.Equal(uint64(22), rec.Packets)
+	assert.Equal(uint64(132), rec.Bytes)
+
+	// Lenient mode doesn't allow to miss group-by columns
+	require.NoError(opts.GroupBy.Set("Source.IP"))
+	r = csv.NewReader(strings.NewReader(input))
+	_, _, err = NewInputHeader(r, opts)
+	require.ErrorAs(err, &herr)
+	assert.Equal([]string{"Source.IP"}, herr.Missing)
+
+	// Auto detection with lenient mode
+	r = csv.NewReader(strings.NewReader(input))
+	_, opts, err = NewInputHeader(r, &Options{Lenient: true})
+	require.NoError(err)
+	assert.Equal("cicflowmeter", opts.Schema.Name)
+}
+
 func TestExtractField(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -56,15 +112,20 @@ func TestExtractField(t *testing.T) {
 	for k, want := range tests {
 		assert.Equal(h.extractField(k, record), want)
 	}
+	assert.Empty(h.extractField("D", record))
 }
 
 func TestGenUniqID(t *testing.T) {
 	rec := &CSVRecord{
-		TimeID:    "A",
-		DstIP:     "1.1.1.1",
-		ProtoName: "GOOGLE",
+		TimeID: "A",
+		Keys:   []string{"1.1.1.1", "GOOGLE"},
 	}
-	assert.Equal(t, rec.genUniqID(), "A-1.1.1.1-GOOGLE")
+	assert.Equal(t, rec.genUniqID(), "A\x001.1.1.1\x00GOOGLE")
+
+	// Different keys must not produce the same ID
+	rec1 := &CSVRecord{TimeID: "A", Keys: []string{"a-b", "c"}}
+	rec2 := &CSVRecord{TimeID: "A", Keys: []string{"a", "b-c"}}
+	assert.NotEqual(t, rec1.genUniqID(), rec2.genUniqID())
 }
 
 func makeTestRecord() (*CSVRecord, error) {
@@ -74,7 +135,7 @@ func makeTestRecord() (*CSVRecord, error) {
 		return nil, err
 	}
 
-	rec, err := NewRecord(h, r)
+	rec, err := NewRecord(h, r, NewOptions())
 	if err != nil {
 		return nil, err
 	}
@@ -90,13 +151,12 @@ func TestNewRecord(t *testing.T) {
 	require.NoError(err)
 
 	want := &CSVRecord{
-		h:         rec.h,
-		TimeID:    "2017-04-26-11",
-		DstIP:     "172.19.1.46",
-		ProtoName: "HTTP_PROXY",
-		ID:        rec.genUniqID(),
-		Packets:   uint64(77),
-		Bytes:     uint64(110546),
+		h:       rec.h,
+		TimeID:  "2017-04-26-11",
+		Keys:    []string{"172.19.1.46", "HTTP_PROXY"},
+		ID:      rec.genUniqID(),
+		Packets: uint64(77),
+		Bytes:   uint64(110546),
 	}
 	assert.Equal(rec, want)
 }
@@ -143,10 +203,65 @@ func TestWriteCSV(t *testing.T) {
 func TestWriteCSVHeader(t *testing.T) {
 	b := new(bytes.Buffer)
 	w := csv.NewWriter(b)
-	WriteCSVHeader(w)
+	WriteCSVHeader(w, NewOptions())
+	w.Flush()
+
+	assert.Equal(t, b.String(),
+		"Timestamp,Destination.IP,ProtocolName,Packets,Bytes\n")
+}
+
+func TestGroupBy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	require.NoError(opts.GroupBy.Set("ProtocolName,Total.Fwd.Packets"))
+
+	r := csv.NewReader(strings.NewReader(testRecord2))
+	h, err := NewHeader(r)
+	require.NoError(err)
+
+	rec, err := NewRecord(h, r, opts)
+	require.NoError(err)
+	assert.Equal([]string{"HTTP_PROXY", "22"}, rec.Keys)
+
+	b := new(bytes.Buffer)
+	w := csv.NewWriter(b)
+	require.NoError(WriteCSVHeader(w, opts))
+	require.NoError(rec.WriteCSV(w))
 	w.Flush()
 
-	assert.Equal(t, b.String(), strings.Join(outHeaderRecord, ",")+"\n")
+	want := `Timestamp,ProtocolName,Total.Fwd.Packets,Packets,Bytes
+2017-04-26-11,HTTP_PROXY,22,77,110546
+`
+	assert.Equal(want, b.String())
+
+	r = csv.NewReader(strings.NewReader(b.String()))
+	h, err = NewHeader(r)
+	require.NoError(err)
+	compact, err := NewRecordCompact(h, r, opts)
+	require.NoError(err)
+	assert.Equal(rec.ID, compact.ID)
+}
+
+func TestColumnsSet(t *testing.T) {
+	assert := assert.New(t)
+
+	var columns Columns
+	assert.NoError(columns.Set("Source.IP, Destination.Port"))
+	assert.Equal(Columns{"Source.IP", "Destination.Port"}, columns)
+	assert.Equal("Source.IP,Destination.Port", columns.String())
+
+	assert.NoError(columns.Set(""))
+	assert.Empty(columns)
+
+	assert.Error(columns.Set("A,,B"))
+	assert.Error(columns.Set("A,B,A"))
+
+	for _, col := range []string{"Timestamp", "Packets", "Bytes", "Flows",
+		"FwdBytes", "BytesError"} {
+		assert.Error(columns.Set("Destination.IP,"+col), col)
+	}
 }
 
 func makeTestRecordCompact() (*CSVRecord, error) {
@@ -156,7 +271,7 @@ func makeTestRecordCompact() (*CSVRecord, error) {
 		return nil, err
 	}
 
-	rec, err := NewRecordCompact(h, r)
+	rec, err := NewRecordCompact(h, r, NewOptions())
 	if err != nil {
 		return nil, err
 	}
@@ -172,13 +287,65 @@ func TestNewRecordCompact(t *testing.T) {
 	require.NoError(err)
 
 	want := &CSVRecord{
-		h:         rec.h,
-		TimeID:    "2017-04-26-11",
-		DstIP:     "172.19.1.46",
-		ProtoName: "HTTP_PROXY",
-		ID:        rec.genUniqID(),
-		Packets:   uint64(77),
-		Bytes:     uint64(110546),
+		h:       rec.h,
+		TimeID:  "2017-04-26-11",
+		Keys:    []string{"172.19.1.46", "HTTP_PROXY"},
+		ID:      rec.genUniqID(),
+		Packets: uint64(77),
+		Bytes:   uint64(110546),
 	}
 	assert.Equal(rec, want)
 }
+
+func TestNewRecordRowError(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	input := `Destination.IP,Timestamp,Total.Fwd.Packets,Total.Backward.Packets,Total.Length.of.Fwd.Packets,Total.Length.of.Bwd.Packets,ProtocolName
+172.19.1.46,26/04/2017 11:11:17,22,55,132,110414,HTTP_PROXY
+172.19.1.46,26/04/201711:11:17,22,x,132,110414,HTTP_PROXY
+172.19.1.46,26/04/201711:11:17,22
+172.19.1.46,26/04/201711:11:17,22,55,132,110414,HTTP_PROXY`
+
+	r := csv.NewReader(strings.NewReader(input))
+	r.ReuseRecord = true
+	h, opts, err := NewInputHeader(r, NewOptions())
+	require.NoError(err)
+
+	tests := []struct {
+		line   int
+		reason string
+	}{
+		{2, ReasonBadTimestamp},
+		{3, ReasonBadCounter},
+		{4, ReasonFieldCount},
+	}
+	for _, test := range tests {
+		_, err := NewRecord(h, r, opts)
+		var rowErr *RowError
+		require.ErrorAs(err, &rowErr)
+		assert.Equal(test.line, rowErr.Line)
+		assert.Equal(test.reason, rowErr.Reason)
+		assert.NotEmpty(rowErr.Record)
+	}
+
+	// It continues with the next line
+	rec, err := NewRecord(h, r, opts)
+	require.NoError(err)
+	assert.Equal(uint64(77), rec.Packets)
+
+	// Every wrong counter has the same reason, the error tells what's wrong
+	for value, want := range map[string]error{
+		"-1":   errNegativeCounter,
+		"1.5":  errFractionalCounter,
+		"1e20": ErrCounterOverflow,
+	} {
+		record := []string{"172.19.1.46", "26/04/201711:11:17", value, "55",
+			"132", "110414", "HTTP_PROXY"}
+		_, err := ParseRecord(h, record, 7, opts)
+		var rowErr *RowError
+		require.ErrorAs(err, &rowErr, value)
+		assert.Equal(ReasonBadCounter, rowErr.Reason, value)
+		assert.ErrorIs(err, want, value)
+	}
+}
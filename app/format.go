@@ -0,0 +1,121 @@
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+// Formats of output files
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+// Format defines format of output files. Zero value means [FormatCSV].
+type Format string
+
+// String returns name of the format. It implements [flag.Value].
+func (self *Format) String() string {
+	if *self == "" {
+		return FormatCSV
+	}
+	return string(*self)
+}
+
+// Set checks s is a known format and assigns it. It implements [flag.Value].
+func (self *Format) Set(s string) error {
+	switch s {
+	case FormatCSV, FormatJSONL, FormatParquet:
+		*self = Format(s)
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, expected %s, %s or %s",
+		s, FormatCSV, FormatJSONL, FormatParquet)
+}
+
+// Ext returns extension of files in this format, like ".csv"
+func (self Format) Ext() string {
+	if self == "" {
+		return "." + FormatCSV
+	}
+	return "." + string(self)
+}
+
+// RecordWriter writes aggregated data in some output format
+type RecordWriter interface {
+	// WriteHeader writes header of output, if the format has it
+	WriteHeader() error
+	// Write writes one aggregated record
+	Write(rec *CSVRecord) error
+	// Close writes any buffered data and reports any error happened before. It
+	// doesn't close underlying writer.
+	Close() error
+}
+
+// NewRecordWriter returns [RecordWriter], which writes into w in opts.Format
+func NewRecordWriter(w io.Writer, opts *Options) RecordWriter {
+	switch opts.Format {
+	case FormatJSONL:
+		return newJSONLWriter(w, opts)
+	case FormatParquet:
+		return newParquetWriter(w, opts)
+	}
+	return &csvRecordWriter{w: csv.NewWriter(w), opts: opts}
+}
+
+// RecordReader reads back aggregated data, written by [RecordWriter]
+type RecordReader interface {
+	// Read returns next record or nil on EOF
+	Read() (*CSVRecord, error)
+}
+
+// NewRecordReader returns [RecordReader], which reads r in opts.Format. r must
+// be written by [RecordWriter] with the same opts.
+func NewRecordReader(r io.Reader, opts *Options) (RecordReader, error) {
+	switch opts.Format {
+	case FormatJSONL:
+		return newJSONLReader(r, opts), nil
+	case FormatParquet:
+		return newParquetReader(r, opts)
+	}
+
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true // Reuse some memory for performance
+	h, err := NewCompactHeader(cr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &csvRecordReader{h: h, r: cr, opts: opts}, nil
+}
+
+// csvRecordWriter writes aggregated data in CSV format
+type csvRecordWriter struct {
+	w    *csv.Writer
+	opts *Options
+}
+
+func (self *csvRecordWriter) WriteHeader() error {
+	return WriteCSVHeader(self.w, self.opts)
+}
+
+func (self *csvRecordWriter) Write(rec *CSVRecord) error {
+	return rec.WriteCSV(self.w)
+}
+
+func (self *csvRecordWriter) Close() error {
+	self.w.Flush()
+	return self.w.Error()
+}
+
+// csvRecordReader reads aggregated data in CSV format
+type csvRecordReader struct {
+	h    CSVHeader
+	r    *csv.Reader
+	opts *Options
+}
+
+func (self *csvRecordReader) Read() (*CSVRecord, error) {
+	return NewRecordCompact(self.h, self.r, self.opts)
+}
@@ -1,161 +1,165 @@
 package app
 
 import (
-	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path"
+	"strconv"
 )
 
 // HourData keeps aggregated data, indexed by day-hour.
 type HourData map[string]*CSVRecord
 
 // Add inserts new data into the map or adds new bytes and packets to existing
-// data
-func (self HourData) Add(netflow *CSVRecord) {
+// data. It returns [ErrCounterOverflow], if a sum overflows, see
+// [CSVRecord.Add].
+func (self HourData) Add(netflow *CSVRecord) error {
 	if nf, present := self[netflow.ID]; present {
-		nf.Add(netflow)
-	} else {
-		self[netflow.ID] = netflow
+		return nf.Add(netflow)
 	}
+	self[netflow.ID] = netflow
+	return nil
 }
 
-// NewSeenHourData returns initialized [*seenHourData]
-func NewSeenHourData() *SeenHourData {
-	return &SeenHourData{
-		seen: make(map[string]bool),
+// createHourFile returns new [*hourFile], which replaces fname on commit. It
+// writes header line, if the format has it.
+func createHourFile(fname string, opts *Options) (*hourFile, error) {
+	f, err := createHiddenFile(fname)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// SeenHourData collects aggregated data for one day-hour and keeps a map of
-// previously flushed day-hours.
-type SeenHourData struct {
-	timeID string          // current day-hour ID
-	data   HourData        // aggregated data for this day-hour
-	seen   map[string]bool // map of known day-hours
-}
-
-// FirstTime return true if this seenHourData just created and empty
-func (self *SeenHourData) FirstTime() bool {
-	return self.timeID == ""
-}
-
-// AnotherHour return true if netflow contains data for another day-hour
-func (self *SeenHourData) AnotherHour(netflow *CSVRecord) bool {
-	return self.timeID != netflow.TimeID
-}
+	self := &hourFile{fname: fname, f: f}
 
-// RememberTimeID remembers day-hour from netflow, so we can use anotherHour to
-// recognize netflow from next day-hour.
-func (self *SeenHourData) RememberTimeID(netflow *CSVRecord) {
-	self.timeID = netflow.TimeID
-}
-
-// hourData returns map of aggregated hourData
-func (self *SeenHourData) hourData() HourData {
-	return self.data
-}
+	if self.cw, err = opts.fileCompress().NewWriter(f); err != nil {
+		self.Close()
+		return nil, err
+	}
+	self.w = NewRecordWriter(self.cw, opts)
+	if err := self.w.WriteHeader(); err != nil {
+		self.Close()
+		return nil, err
+	}
 
-// ResetHourData resets internal storage for aggregated hourData. After that
-// it's ready for collecting new data. Also should be called before first use of
-// this seenHourData.
-func (self *SeenHourData) ResetHourData() {
-	self.data = make(HourData)
+	return self, nil
 }
 
-// FlushHourData saves aggregated data into outPath/timeID.csv file and resets
-// internal storage. If we already saved data into this .csv file, it appends
-// data into the file. If such file exist and we haven't yet saved any data into
-// it, FlushHourData overwrites this file, because it means, this file left here
-// from prev exec.
-func (self *SeenHourData) FlushHourData(outPath string) error {
-	curTimeID := self.timeID
-	if _, present := self.seen[curTimeID]; present {
-		if err := appendHourToFile(curTimeID, self.data, outPath); err != nil {
-			return err
+// createHiddenFile creates new hidden file with random name like .fname-123 in
+// dir of fname, so consumers of the dir don't pick it up, if we crash before
+// it's renamed. Unlike [os.CreateTemp], it creates the file with mode 0666
+// before umask, like [os.Create] does, so the file can replace output file.
+func createHiddenFile(fname string) (*os.File, error) {
+	dir, base := path.Dir(fname), path.Base(fname)
+	for try := 0; ; try++ {
+		name := path.Join(dir, "."+base+"-"+strconv.FormatUint(
+			uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, fs.ErrExist) && try < 10000 {
+			continue
 		}
-	} else {
-		if err := SaveHourToFile(curTimeID, self.data, outPath); err != nil {
-			return err
-		}
-		self.seen[curTimeID] = true
+		return f, err
 	}
-	self.ResetHourData()
+}
 
-	return nil
+// hourFile writes output file fname through hidden temporary file in the same
+// dir, which replaces fname on commit. So fname always contains either old data
+// or new data, but never a mix of them, even if we crash in the middle.
+type hourFile struct {
+	fname  string         // output file
+	f      *os.File       // temporary file, nil after commit
+	cw     io.WriteCloser // compressor of temporary file
+	w      RecordWriter   // writer of records into cw
+	commit func()         // called after successful commit, if set
 }
 
-// AddHourData inserts new netflow into data map or adds new bytes and packets
-// to existing data
-func (self *SeenHourData) AddHourData(netflow *CSVRecord) {
-	self.hourData().Add(netflow)
+// Write writes aggregated record into temporary file
+func (self *hourFile) Write(netflow *CSVRecord) error {
+	return self.w.Write(netflow)
 }
 
-// SaveHourToFile saves data into outPath/timeID.csv. If such file exists it
-// overwrites it. First line is a header line with name of fields.
-func SaveHourToFile(timeID string, data HourData, outPath string) error {
-	fname := path.Join(outPath, timeID+".csv")
-	f, err := os.Create(fname)
-	if err != nil {
+// Commit flushes temporary file and renames it to the output file. It syncs
+// the dir after that, so the rename survives a crash too.
+func (self *hourFile) Commit() error {
+	if err := self.w.Close(); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	if err := writeHourToFile(f, data, true); err != nil {
+	// Closing of compressor flushes compressed data
+	if err := self.cw.Close(); err != nil {
 		return err
 	}
-
-	return nil
-}
-
-// writeHourToFile writes data into file f. header flag shows does it need
-// header line or doesn't. If header == true first line of the file is a header
-// line with name of fields.
-func writeHourToFile(f *os.File, data HourData, header bool) error {
-	w := csv.NewWriter(f)
-
-	if header {
-		if err := WriteCSVHeader(w); err != nil {
-			return err
-		}
+	if err := self.f.Sync(); err != nil {
+		return err
 	}
-
-	if err := writeHour(w, data); err != nil {
+	if err := self.f.Close(); err != nil {
 		return err
 	}
-
-	w.Flush()
-	if err := w.Error(); err != nil {
+	if err := os.Rename(self.f.Name(), self.fname); err != nil {
 		return err
 	}
+	// Output file is already replaced, nothing to remove on Close
+	self.f = nil
+	if self.commit != nil {
+		self.commit()
+	}
 
-	return nil
+	return syncDir(path.Dir(self.fname))
 }
 
-// writeHour writes aggregated data in CSV format to w
-func writeHour(w *csv.Writer, data HourData) error {
-	for _, v := range data {
-		if err := v.WriteCSV(w); err != nil {
-			return err
-		}
+// Close removes temporary file, if it isn't committed. It does nothing after
+// commit.
+func (self *hourFile) Close() error {
+	if self.f == nil {
+		return nil
 	}
-
-	return nil
+	self.f.Close()
+	return os.Remove(self.f.Name())
 }
 
-// appendHourToFile appends data to outPath/timeID.csv file. We assume this file
-// already has header line, because [saveHourToFile] added it, when created this
-// file.
-func appendHourToFile(timeID string, data HourData, outPath string) error {
-	fname := path.Join(outPath, timeID+".csv")
-	f, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+// syncDir flushes entries of dir, like renamed files, to disk
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	return f.Sync()
+}
 
-	if err := writeHourToFile(f, data, false); err != nil {
-		return err
-	}
+// fileRows returns source of aggregated records of file fname, written with
+// opts.
+func fileRows(fname string, opts *Options) rowSource {
+	return func(emit func(netflow *CSVRecord) error) error {
+		var f io.ReadCloser
+		var err error
+		if opts.Format == FormatParquet {
+			// Parquet needs random access to the file, it's never compressed
+			// as a whole.
+			f, err = os.Open(fname)
+		} else {
+			f, err = OpenInput(fname)
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
 
-	return nil
+		r, err := NewRecordReader(f, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fname, err)
+		}
+		for {
+			netflow, err := r.Read()
+			if err != nil {
+				return fmt.Errorf("%s: %w", fname, err)
+			} else if netflow == nil {
+				return nil
+			}
+			if err := emit(netflow); err != nil {
+				return err
+			}
+		}
+	}
 }
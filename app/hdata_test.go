@@ -4,6 +4,7 @@ import (
 	"encoding/csv"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -23,46 +24,16 @@ func TestHourDataAdd(t *testing.T) {
 	assert.Equal(rec.Bytes, uint64(6))
 }
 
-func TestNewSeenHourData(t *testing.T) {
-	assert := assert.New(t)
-
-	seenHD := NewSeenHourData()
-	assert.True(seenHD.FirstTime())
-
-	rec := &CSVRecord{TimeID: "123", ID: "A", Packets: 1, Bytes: 2}
-	assert.True(seenHD.AnotherHour(rec))
-
-	seenHD.RememberTimeID(rec)
-	assert.False(seenHD.AnotherHour(rec))
-	assert.Equal(seenHD.timeID, "123")
-	assert.Nil(seenHD.hourData())
-
-	seenHD.ResetHourData()
-	assert.NotNil(seenHD.hourData())
-
-	seenHD.AddHourData(rec)
-	assert.Contains(seenHD.hourData(), "A")
-
-	seenHD.AddHourData(&CSVRecord{TimeID: "123", ID: "A", Packets: 3, Bytes: 4})
-	hd := seenHD.hourData()["A"]
-	assert.Equal(hd.Packets, uint64(4))
-	assert.Equal(hd.Bytes, uint64(6))
-}
-
-func TestFlushHourData(t *testing.T) {
+func TestOutDirWriteHour(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
 	netflow, err := makeTestRecordCompact()
 	require.NoError(err)
 
-	seenTimeID := NewSeenHourData()
-	seenTimeID.RememberTimeID(netflow)
-	seenTimeID.ResetHourData()
-	seenTimeID.AddHourData(netflow)
-
 	outPath := t.TempDir()
-	require.NoError(seenTimeID.FlushHourData(outPath))
+	sink := NewOutDir(outPath, t.TempDir(), NewOptions())
+	require.NoError(sink.WriteHour(netflow.TimeID, HourData{netflow.ID: netflow}))
 
 	fname := path.Join(outPath, netflow.TimeID+".csv")
 	netflows, err := loadRecordsCompact(fname)
@@ -70,19 +41,49 @@ func TestFlushHourData(t *testing.T) {
 	assert.Len(netflows, 1)
 	assert.Equal(netflow, netflows[0])
 
-	seenTimeID.AddHourData(netflow)
-	require.NoError(seenTimeID.FlushHourData(outPath))
+	// The second write adds data to data of the file
+	require.NoError(sink.WriteHour(netflow.TimeID, HourData{netflow.ID: netflow}))
 
 	netflows, err = loadRecordsCompact(fname)
 	require.NoError(err)
-	assert.Len(netflows, 2)
-	for i := 0; i < len(netflows); i++ {
-		require.Equal(netflow, netflows[i])
+	require.Len(netflows, 1)
+	assert.Equal(netflow.ID, netflows[0].ID)
+	assert.Equal(2*netflow.Packets, netflows[0].Packets)
+	assert.Equal(2*netflow.Bytes, netflows[0].Bytes)
+	assertDirFiles(t, outPath, netflow.TimeID+".csv")
+}
+
+func TestOutDirWriteHourCompress(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	netflow, err := makeTestRecordCompact()
+	require.NoError(err)
+
+	for _, compress := range []string{CompressGzip, CompressZstd} {
+		opts := NewOptions()
+		require.NoError(opts.Compress.Set(compress))
+
+		// The second write adds data to data of the file
+		outPath := t.TempDir()
+		sink := NewOutDir(outPath, t.TempDir(), opts)
+		for i := 0; i < 2; i++ {
+			data := HourData{netflow.ID: netflow}
+			require.NoError(sink.WriteHour(netflow.TimeID, data))
+		}
+
+		fname := path.Join(outPath, netflow.TimeID+".csv"+opts.Compress.Ext())
+		assert.FileExists(fname)
+		netflows, err := loadRecordsCompact(fname)
+		require.NoError(err)
+		require.Len(netflows, 1)
+		assert.Equal(2*netflow.Packets, netflows[0].Packets)
+		assert.Equal(2*netflow.Bytes, netflows[0].Bytes)
 	}
 }
 
 func loadRecordsCompact(fname string) ([]*CSVRecord, error) {
-	file, err := os.Open(fname)
+	file, err := OpenInput(fname)
 	if err != nil {
 		return nil, err
 	}
@@ -96,7 +97,7 @@ func loadRecordsCompact(fname string) ([]*CSVRecord, error) {
 
 	records := make([]*CSVRecord, 0)
 	for {
-		if rec, err := NewRecordCompact(h, r); err == nil {
+		if rec, err := NewRecordCompact(h, r, NewOptions()); err == nil {
 			if rec == nil {
 				break
 			}
@@ -108,3 +109,70 @@ func loadRecordsCompact(fname string) ([]*CSVRecord, error) {
 
 	return records, nil
 }
+
+func TestHourFile(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	netflow, err := makeTestRecordCompact()
+	require.NoError(err)
+
+	outPath := t.TempDir()
+	fname := path.Join(outPath, netflow.TimeID+".csv")
+	require.NoError(os.WriteFile(fname, []byte("garbage"), 0666))
+	old, err := os.Stat(fname)
+	require.NoError(err)
+
+	f, err := createHourFile(fname, NewOptions())
+	require.NoError(err)
+	require.NoError(f.Write(netflow))
+	require.NoError(f.Commit())
+	require.NoError(f.Close())
+	assertDirFiles(t, outPath, netflow.TimeID+".csv")
+	// Mode of output file follows umask, like mode of file by os.WriteFile
+	info, err := os.Stat(fname)
+	require.NoError(err)
+	assert.Equal(old.Mode().Perm(), info.Mode().Perm())
+
+	netflows, err := loadRecordsCompact(fname)
+	require.NoError(err)
+	assert.Equal([]*CSVRecord{netflow}, netflows)
+
+	// Failed write keeps old file as is and removes its temporary file
+	f, err = createHourFile(fname, NewOptions())
+	require.NoError(err)
+	require.NoError(f.Write(netflow))
+	assertDirFiles(t, outPath, netflow.TimeID+".csv", path.Base(f.f.Name()))
+	assert.True(strings.HasPrefix(path.Base(f.f.Name()), "."), f.f.Name())
+	require.NoError(f.Close())
+	assertDirFiles(t, outPath, netflow.TimeID+".csv")
+
+	netflows, err = loadRecordsCompact(fname)
+	require.NoError(err)
+	assert.Equal([]*CSVRecord{netflow}, netflows)
+}
+
+// assertDirFiles asserts dir contains files names only
+func assertDirFiles(t *testing.T, dir string, names ...string) {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	got := make([]string, len(entries))
+	for i, entry := range entries {
+		got[i] = entry.Name()
+	}
+	assert.ElementsMatch(t, names, got)
+}
+
+// loadHourFile reads and aggregates data of output file fname, written with
+// the same opts.
+func loadHourFile(fname string, opts *Options) (HourData, error) {
+	data := make(HourData)
+	err := fileRows(fname, opts)(func(netflow *CSVRecord) error {
+		return opts.Overflow.check(data.Add(netflow))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
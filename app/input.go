@@ -0,0 +1,97 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Magic bytes of compressed streams we can decompress
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// OpenInput opens input file fname for reading, or stdin if fname is "-". If
+// the file is compressed by gzip, zstd, bzip2 or xz, it returns reader of
+// decompressed data. See [NewDecompressReader].
+func OpenInput(fname string) (io.ReadCloser, error) {
+	if fname == "-" {
+		return NewDecompressReader(io.NopCloser(os.Stdin))
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewDecompressReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// NewDecompressReader returns reader of decompressed data from r. It detects
+// compression by magic bytes in the beginning of r, not by file extension, and
+// returns data as is, if it isn't compressed. Closing of returned reader closes
+// r too.
+func NewDecompressReader(r io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	// Peek returns less bytes and an error for short input, it's ok here.
+	magic, _ := br.Peek(len(xzMagic))
+
+	var dr io.Reader
+	var closer func()
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		dr, closer = zr, func() { zr.Close() }
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		dr, closer = zr, zr.Close
+	case bytes.HasPrefix(magic, bzip2Magic):
+		dr = bzip2.NewReader(br)
+	case bytes.HasPrefix(magic, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		dr = xr
+	default:
+		dr = br
+	}
+
+	return &decompressReader{Reader: dr, closer: closer, r: r}, nil
+}
+
+// decompressReader reads decompressed data and closes both decompressor and
+// underlying reader.
+type decompressReader struct {
+	io.Reader
+	closer func()        // releases resources of decompressor, can be nil
+	r      io.ReadCloser // underlying reader
+}
+
+func (self *decompressReader) Close() error {
+	if self.closer != nil {
+		self.closer()
+	}
+	return self.r.Close()
+}
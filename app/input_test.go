@@ -0,0 +1,88 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+const testInput = "A,B,C\n1,2,3\n"
+
+// testInput compressed by bzip2, because there is no bzip2 compressor in
+// standard library.
+var testInputBzip2 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x55, 0x92,
+	0x90, 0x7a, 0x00, 0x00, 0x04, 0xdc, 0x00, 0x00, 0x10, 0x00, 0x04, 0x38,
+	0x00, 0x38, 0x00, 0x20, 0x00, 0x31, 0x0c, 0x08, 0x1a, 0x68, 0xc2, 0x56,
+	0x9c, 0xb2, 0x82, 0x47, 0x8b, 0xb9, 0x22, 0x9c, 0x28, 0x48, 0x2a, 0xc9,
+	0x48, 0x3d, 0x00,
+}
+
+func compressTestInput(t *testing.T, newWriter func(io.Writer) io.WriteCloser) []byte {
+	b := new(bytes.Buffer)
+	w := newWriter(b)
+	_, err := w.Write([]byte(testInput))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+func TestOpenInput(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tests := map[string][]byte{
+		"plain": []byte(testInput),
+		"gzip": compressTestInput(t, func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		}),
+		"zstd": compressTestInput(t, func(w io.Writer) io.WriteCloser {
+			zw, err := zstd.NewWriter(w)
+			require.NoError(err)
+			return zw
+		}),
+		"xz": compressTestInput(t, func(w io.Writer) io.WriteCloser {
+			xw, err := xz.NewWriter(w)
+			require.NoError(err)
+			return xw
+		}),
+		"bzip2": testInputBzip2,
+	}
+
+	dir := t.TempDir()
+	for name, data := range tests {
+		// Extension doesn't matter
+		fname := path.Join(dir, name+".csv")
+		require.NoError(os.WriteFile(fname, data, 0666), name)
+
+		r, err := OpenInput(fname)
+		require.NoError(err, name)
+		got, err := io.ReadAll(r)
+		require.NoError(err, name)
+		assert.Equal(testInput, string(got), name)
+		assert.NoError(r.Close(), name)
+	}
+
+	_, err := OpenInput(path.Join(dir, "not-exists.csv"))
+	assert.Error(err)
+}
+
+func TestOpenInputShort(t *testing.T) {
+	fname := path.Join(t.TempDir(), "short.csv")
+	require.NoError(t, os.WriteFile(fname, []byte("A"), 0666))
+
+	r, err := OpenInput(fname)
+	require.NoError(t, err)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "A", string(got))
+}
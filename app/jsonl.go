@@ -0,0 +1,145 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// newJSONLWriter returns initialized [*jsonlWriter]
+func newJSONLWriter(w io.Writer, opts *Options) *jsonlWriter {
+	header := outHeaderRecord(opts)
+	keys := make([][]byte, len(header))
+	for i, col := range header {
+		// Marshaling of string can't fail
+		keys[i], _ = json.Marshal(col)
+	}
+
+	return &jsonlWriter{
+		w:        bufio.NewWriter(w),
+		keys:     keys,
+		numStart: 1 + len(opts.GroupBy),
+	}
+}
+
+// jsonlWriter writes aggregated data in JSON Lines format, one JSON object per
+// line, like
+//
+//	{"Timestamp":"2017-04-26-11","Destination.IP":"172.19.1.46","ProtocolName":"HTTP_PROXY","Packets":77,"Bytes":110546}
+//
+// Keys of the object are columns of our output .csv, counters are numbers.
+type jsonlWriter struct {
+	w        *bufio.Writer
+	keys     [][]byte // JSON encoded columns of output
+	numStart int      // index of the first numeric column
+	buf      []byte   // reusable buffer for one line
+}
+
+// WriteHeader does nothing, JSON Lines has no header
+func (self *jsonlWriter) WriteHeader() error {
+	return nil
+}
+
+func (self *jsonlWriter) Write(rec *CSVRecord) error {
+	values := rec.outRecord()
+	if len(values) != len(self.keys) {
+		return fmt.Errorf("record %q has %d fields, expected %d",
+			rec.TimeID, len(values), len(self.keys))
+	}
+
+	buf := append(self.buf[:0], '{')
+	for i, v := range values {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, self.keys[i]...)
+		buf = append(buf, ':')
+		if i >= self.numStart {
+			buf = append(buf, v...)
+		} else {
+			s, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			buf = append(buf, s...)
+		}
+	}
+	buf = append(buf, '}', '\n')
+	self.buf = buf
+
+	_, err := self.w.Write(buf)
+	return err
+}
+
+func (self *jsonlWriter) Close() error {
+	return self.w.Flush()
+}
+
+// newJSONLReader returns initialized [*jsonlReader]
+func newJSONLReader(r io.Reader, opts *Options) *jsonlReader {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	return &jsonlReader{d: d, opts: opts}
+}
+
+// jsonlReader reads aggregated data, written by [jsonlWriter]
+type jsonlReader struct {
+	d    *json.Decoder
+	opts *Options
+}
+
+func (self *jsonlReader) Read() (*CSVRecord, error) {
+	var obj map[string]interface{}
+	if err := self.d.Decode(&obj); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rec := new(CSVRecord)
+	var err error
+	if rec.TimeID, err = jsonlString(obj, "Timestamp"); err != nil {
+		return nil, err
+	}
+	rec.Keys = make([]string, len(self.opts.GroupBy))
+	for i, col := range self.opts.GroupBy {
+		if rec.Keys[i], err = jsonlString(obj, col); err != nil {
+			return nil, err
+		}
+	}
+	rec.ID = rec.genUniqID()
+
+	if rec.Packets, err = jsonlUint(obj, "Packets"); err != nil {
+		return nil, err
+	}
+	if rec.Bytes, err = jsonlUint(obj, "Bytes"); err != nil {
+		return nil, err
+	}
+	rec.setMetrics(self.opts.metrics())
+	for i, m := range rec.metrics {
+		if rec.Metrics[i], err = jsonlUint(obj, m.name); err != nil {
+			return nil, err
+		}
+	}
+
+	return rec, nil
+}
+
+// jsonlString returns string value of key from obj
+func jsonlString(obj map[string]interface{}, key string) (string, error) {
+	if s, ok := obj[key].(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("%q isn't a string: %v", key, obj[key])
+}
+
+// jsonlUint returns uint64 value of key from obj
+func jsonlUint(obj map[string]interface{}, key string) (uint64, error) {
+	n, ok := obj[key].(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%q isn't a number: %v", key, obj[key])
+	}
+	return strconv.ParseUint(n.String(), 10, 64)
+}
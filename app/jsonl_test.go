@@ -0,0 +1,117 @@
+package app
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatSet(t *testing.T) {
+	assert := assert.New(t)
+
+	var f Format
+	assert.Equal("csv", f.String())
+	assert.Equal(".csv", f.Ext())
+
+	assert.NoError(f.Set("jsonl"))
+	assert.Equal("jsonl", f.String())
+	assert.Equal(".jsonl", f.Ext())
+
+	assert.Error(f.Set("xml"))
+}
+
+func TestJSONLWriter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rec, err := makeTestRecord()
+	require.NoError(err)
+
+	opts := NewOptions()
+	require.NoError(opts.Format.Set(FormatJSONL))
+
+	b := new(bytes.Buffer)
+	w := NewRecordWriter(b, opts)
+	require.NoError(w.WriteHeader())
+	require.NoError(w.Write(rec))
+	rec.Keys[1] = `quoted "proto"`
+	require.NoError(w.Write(rec))
+	require.NoError(w.Close())
+
+	want := `{"Timestamp":"2017-04-26-11","Destination.IP":"172.19.1.46","ProtocolName":"HTTP_PROXY","Packets":77,"Bytes":110546}
+{"Timestamp":"2017-04-26-11","Destination.IP":"172.19.1.46","ProtocolName":"quoted \"proto\"","Packets":77,"Bytes":110546}
+`
+	assert.Equal(want, b.String())
+
+	r, err := NewRecordReader(strings.NewReader(want), opts)
+	require.NoError(err)
+	got, err := r.Read()
+	require.NoError(err)
+	assert.Equal([]string{"172.19.1.46", "HTTP_PROXY"}, got.Keys)
+	assert.Equal(uint64(77), got.Packets)
+	assert.Equal(uint64(110546), got.Bytes)
+
+	got, err = r.Read()
+	require.NoError(err)
+	assert.Equal(rec.Keys, got.Keys)
+	assert.Equal(rec.genUniqID(), got.ID)
+
+	got, err = r.Read()
+	require.NoError(err)
+	assert.Nil(got)
+}
+
+func TestJSONLReaderErrors(t *testing.T) {
+	opts := NewOptions()
+	require.NoError(t, opts.Format.Set(FormatJSONL))
+
+	tests := []string{
+		`{"Timestamp":1}`,
+		`{"Timestamp":"A","Destination.IP":"1.1.1.1","ProtocolName":"DNS","Packets":"1","Bytes":1}`,
+		`{"Timestamp":"A","Destination.IP":"1.1.1.1","ProtocolName":"DNS","Packets":-1,"Bytes":1}`,
+		`not json`,
+	}
+	for _, input := range tests {
+		r, err := NewRecordReader(strings.NewReader(input), opts)
+		require.NoError(t, err)
+		_, err = r.Read()
+		assert.Error(t, err, input)
+	}
+}
+
+func TestOutDirWriteHourJSONL(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	netflow, err := makeTestRecordCompact()
+	require.NoError(err)
+
+	opts := NewOptions()
+	require.NoError(opts.Format.Set(FormatJSONL))
+	require.NoError(opts.Compress.Set(CompressGzip))
+
+	outPath := t.TempDir()
+	sink := NewOutDir(outPath, t.TempDir(), opts)
+	for i := 0; i < 2; i++ {
+		require.NoError(sink.WriteHour(netflow.TimeID, HourData{netflow.ID: netflow}))
+	}
+
+	file, err := OpenInput(path.Join(outPath, netflow.TimeID+".jsonl.gz"))
+	require.NoError(err)
+	defer file.Close()
+
+	r, err := NewRecordReader(file, opts)
+	require.NoError(err)
+	rec, err := r.Read()
+	require.NoError(err)
+	require.NotNil(rec)
+	assert.Equal(netflow.ID, rec.ID)
+	assert.Equal(2*netflow.Packets, rec.Packets)
+	rec, err = r.Read()
+	require.NoError(err)
+	assert.Nil(rec)
+}
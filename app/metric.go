@@ -0,0 +1,137 @@
+package app
+
+// aggregation defines how values of metric are aggregated
+type aggregation int
+
+// Aggregations of metrics
+const (
+	aggSum       aggregation = iota // sum of values
+	aggMin                          // the smallest value
+	aggMax                          // the largest value
+	aggPerPacket                    // bytes per packet, derived from counters
+)
+
+// apply returns aggregated value of a and b and false if it overflows. In this
+// case the value is saturated to math.MaxUint64. Derived values aren't
+// aggregated, see [CSVRecord.updateDerived].
+func (self aggregation) apply(a, b uint64) (uint64, bool) {
+	switch self {
+	case aggMin:
+		return min(a, b), true
+	case aggMax:
+		return max(a, b), true
+	case aggPerPacket:
+		return a, true
+	}
+	return addCounters(a, b)
+}
+
+// metric is an additional numeric column of output, next to Packets and Bytes
+type metric struct {
+	name   string      // name of output column
+	column string      // name of SQLite column
+	agg    aggregation // how values are aggregated
+}
+
+// Names of output columns of directional counters and flow metrics
+const (
+	metricFwdPackets = "FwdPackets"
+	metricBwdPackets = "BwdPackets"
+	metricFwdBytes   = "FwdBytes"
+	metricBwdBytes   = "BwdBytes"
+
+	metricFlows         = "Flows"
+	metricDurationMin   = "DurationMin"
+	metricDurationMax   = "DurationMax"
+	metricDurationSum   = "DurationSum"
+	metricFirstSeen     = "FirstSeen"
+	metricLastSeen      = "LastSeen"
+	metricAvgPacketSize = "AvgPacketSize"
+)
+
+// directionalMetrics are packets and bytes from source to destination and back,
+// Packets and Bytes are their sums.
+var directionalMetrics = []metric{
+	{name: metricFwdPackets, column: "fwd_packets", agg: aggSum},
+	{name: metricBwdPackets, column: "bwd_packets", agg: aggSum},
+	{name: metricFwdBytes, column: "fwd_bytes", agg: aggSum},
+	{name: metricBwdBytes, column: "bwd_bytes", agg: aggSum},
+}
+
+// flowMetrics are num of flows, their durations in microseconds, the first and
+// the last start of flow in microseconds since Unix epoch and average size of
+// packet.
+var flowMetrics = []metric{
+	{name: metricFlows, column: "flows", agg: aggSum},
+	{name: metricDurationMin, column: "duration_min", agg: aggMin},
+	{name: metricDurationMax, column: "duration_max", agg: aggMax},
+	{name: metricDurationSum, column: "duration_sum", agg: aggSum},
+	{name: metricFirstSeen, column: "first_seen", agg: aggMin},
+	{name: metricLastSeen, column: "last_seen", agg: aggMax},
+	{name: metricAvgPacketSize, column: "avg_packet_size", agg: aggPerPacket},
+}
+
+// metricGroups are groups of metrics, which options can want, in order of
+// output columns.
+var metricGroups = [][]metric{directionalMetrics, flowMetrics, approxMetrics}
+
+// metricSets keeps metrics of every combination of metricGroups, indexed by bit
+// mask of groups, so records of the same options share one slice.
+var metricSets = func() [][]metric {
+	sets := make([][]metric, 1<<len(metricGroups))
+	for mask := range sets {
+		for i, group := range metricGroups {
+			if mask&(1<<i) != 0 {
+				sets[mask] = append(sets[mask], group...)
+			}
+		}
+	}
+	return sets
+}()
+
+// metrics returns additional columns of output, which opts want, in order of
+// output.
+func (self *Options) metrics() []metric {
+	var mask int
+	if self.Directional {
+		mask |= 1 << 0
+	}
+	if self.Metrics {
+		mask |= 1 << 1
+	}
+	if self.Approx > 0 {
+		mask |= 1 << 2
+	}
+	return metricSets[mask]
+}
+
+// metricNames returns names of output columns of metrics
+func metricNames(metrics []metric) []string {
+	names := make([]string, len(metrics))
+	for i, m := range metrics {
+		names[i] = m.name
+	}
+	return names
+}
+
+// setMetrics makes the record keep values of metrics, zeros for now
+func (self *CSVRecord) setMetrics(metrics []metric) {
+	if len(metrics) == 0 {
+		return
+	}
+	self.metrics = metrics
+	self.Metrics = make([]uint64, len(metrics))
+}
+
+// updateDerived calculates values of metrics, derived from counters
+func (self *CSVRecord) updateDerived() {
+	for i, m := range self.metrics {
+		if m.agg != aggPerPacket {
+			continue
+		}
+		self.Metrics[i] = 0
+		if self.Packets > 0 {
+			self.Metrics[i] = self.Bytes / self.Packets
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"encoding/csv"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseTestMetrics parses every line of nfdump input with metrics
+func parseTestMetrics(t *testing.T, input string) HourData {
+	r := csv.NewReader(strings.NewReader(input))
+	opts := NewOptions()
+	opts.Metrics = true
+	h, opts, err := NewInputHeader(r, opts)
+	require.NoError(t, err)
+
+	data := make(HourData)
+	for {
+		rec, err := NewRecord(h, r, opts)
+		require.NoError(t, err)
+		if rec == nil {
+			return data
+		}
+		require.NoError(t, data.Add(rec))
+	}
+}
+
+func TestFlowMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	data := parseTestMetrics(t, testNfdump+`
+2017-04-26 11:30:00,2017-04-26 11:30:03,3.25,10.0.0.2,172.19.1.46,5001,3128,TCP,.AP.SF,1,100,1,20`)
+	require.Len(t, data, 1)
+
+	opts := NewOptions()
+	opts.Metrics = true
+	assert.Equal([]string{"Timestamp", "Destination.IP", "ProtocolName",
+		"Packets", "Bytes", "Flows", "DurationMin", "DurationMax", "DurationSum",
+		"FirstSeen", "LastSeen", "AvgPacketSize"}, outHeaderRecord(opts))
+
+	for _, rec := range data {
+		assert.Equal([]uint64{
+			2,                // Flows
+			1000000,          // DurationMin
+			3250000,          // DurationMax
+			4250000,          // DurationSum
+			1493205077123000, // FirstSeen
+			1493206200000000, // LastSeen
+			110666 / 79,      // AvgPacketSize
+		}, rec.Metrics)
+	}
+}
+
+func TestFlowMetricsBadDuration(t *testing.T) {
+	r := csv.NewReader(strings.NewReader(
+		strings.Replace(testNfdump, ",1.0,", ",x,", 1)))
+	opts := NewOptions()
+	opts.Metrics = true
+	h, opts, err := NewInputHeader(r, opts)
+	require.NoError(t, err)
+
+	_, err = NewRecord(h, r, opts)
+	var rowErr *RowError
+	require.ErrorAs(t, err, &rowErr)
+	assert.Equal(t, ReasonBadDuration, rowErr.Reason)
+}
+
+func TestSQLiteSinkFlowMetrics(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Metrics = true
+	sink, err := NewSQLiteSink(path.Join(t.TempDir(), "flows.db"), opts)
+	require.NoError(err)
+	defer sink.Close()
+
+	first := parseTestMetrics(t, testNfdump)
+	second := parseTestMetrics(t, strings.Replace(testNfdump, ",1.0,", ",3.0,", 1))
+	for _, data := range []HourData{first, second} {
+		for _, rec := range data {
+			require.NoError(sink.WriteHour(rec.TimeID, data))
+		}
+	}
+
+	var flows, durationMin, durationMax, avgPacketSize int64
+	require.NoError(sink.db.QueryRow(
+		"SELECT flows, duration_min, duration_max, avg_packet_size FROM flows",
+	).Scan(&flows, &durationMin, &durationMax, &avgPacketSize))
+	assert.Equal(int64(2), flows)
+	assert.Equal(int64(1000000), durationMin)
+	assert.Equal(int64(3000000), durationMax)
+	assert.Equal(int64(110546/77), avgPacketSize)
+}
+
+func TestDirectionalMetrics(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, input := range []string{testNfdump, testZeek} {
+		r := csv.NewReader(strings.NewReader(input))
+		opts := NewOptions()
+		opts.Directional = true
+		h, opts, err := NewInputHeader(r, opts)
+		require.NoError(err)
+
+		rec, err := NewRecord(h, r, opts)
+		require.NoError(err)
+		assert.Equal(uint64(77), rec.Packets)
+		assert.Equal(uint64(110546), rec.Bytes)
+		assert.Equal([]uint64{22, 55, 132, 110414}, rec.Metrics)
+	}
+
+	opts := NewOptions()
+	opts.Directional = true
+	opts.Metrics = true
+	opts.Approx = 1
+	header := outHeaderRecord(opts)
+	assert.Equal([]string{"Packets", "Bytes", "FwdPackets", "BwdPackets",
+		"FwdBytes", "BwdBytes", "Flows"}, header[3:10])
+	assert.Equal([]string{"PacketsError", "BytesError"}, header[len(header)-2:])
+	assert.Equal([]string{"fwd_packets", "bwd_packets", "fwd_bytes",
+		"bwd_bytes"}, sqliteColumns(opts)[5:9])
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NewOptions returns [*Options] with default settings, which aggregate data by
+// day-hour.
+func NewOptions() *Options {
+	bucket, err := ParseBucket(defBucket)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Options{
+		Bucket:  bucket,
+		GroupBy: Columns{"Destination.IP", "ProtocolName"},
+	}
+}
+
+// Options keeps settings of aggregation. Usually they come from CLI options.
+type Options struct {
+	Bucket  Bucket  // time granularity of aggregation
+	GroupBy Columns // columns of aggregation key in addition to time ID
+	Schema  *Schema // columns of input .csv, nil means detect it
+	Lenient bool    // absent counters in input are zeros
+
+	Overflow Overflow // what to do, when sum of counters overflows
+
+	Compress Compression // compression of output files
+	Format   Format      // format of output files
+	Merge    bool        // add data to existing output files
+	Sort     SortOrder   // order of rows in output files
+	Top      int         // write top N rows of every bucket only, if > 0
+	TopBy    TopBy       // counter, which ranks rows for top N
+	TopOther bool        // write roll-up row of rows not in top N
+	Approx   int         // approximate top N rows of every bucket, if > 0
+
+	Directional bool // write fwd and bwd packets and bytes too
+	Metrics     bool // write num of flows, durations and so on
+}
+
+// Check returns error, if options are out of range or can't work together
+func (self *Options) Check() error {
+	switch {
+	case self.Top < 0:
+		return fmt.Errorf("invalid num of top rows %d: must not be negative",
+			self.Top)
+	case self.Approx < 0:
+		return fmt.Errorf(
+			"invalid num of approximate top rows %d: must not be negative",
+			self.Approx)
+	case self.Approx > maxApprox:
+		return fmt.Errorf("too many approximate top rows %d, max is %d",
+			self.Approx, maxApprox)
+	}
+
+	// Space-Saving row inherits counters of evicted row, their errors are in
+	// PacketsError and BytesError. Metrics of evicted row would be inherited
+	// without any bounds, and the smallest values can't be bounded at all.
+	if self.Approx > 0 && self.Metrics {
+		return errors.New("approximate top rows can't have flow metrics")
+	}
+	return nil
+}
+
+// OutExt returns extension of output files, like ".csv", ".csv.gz" or
+// ".jsonl"
+func (self *Options) OutExt() string {
+	return self.Format.Ext() + self.fileCompress().Ext()
+}
+
+// fileCompress returns compression of output files as a whole. Parquet
+// compresses its pages itself, so we don't compress Parquet files.
+func (self *Options) fileCompress() Compression {
+	if self.Format == FormatParquet {
+		return CompressNone
+	}
+	return self.Compress
+}
+
+// Staging returns copy of the options for intermediate files. They are plain
+// .csv files, because we can cheaply write and read them row by row, and they
+// are always overwritten on the first write.
+func (self *Options) Staging() *Options {
+	opts := *self
+	opts.Format = FormatCSV
+	opts.Compress = CompressNone
+	opts.Merge = false
+	return &opts
+}
+
+// forInput returns copy of the options for input .csv file with header h. If
+// schema isn't set, it detects it using h.
+func (self *Options) forInput(h CSVHeader) (*Options, error) {
+	opts := *self
+	if opts.Schema == nil {
+		schema, err := DetectSchema(h, &opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Schema = schema
+	}
+	return &opts, nil
+}
+
+// requiredColumns returns input columns, which must exist in header line. These
+// are timestamp, group-by columns and counters and duration for metrics, if it
+// isn't lenient mode.
+func (self *Options) requiredColumns() []string {
+	schema := self.schema()
+	seen := make(map[string]bool)
+	var columns []string
+	add := func(col string) {
+		if !seen[col] {
+			seen[col] = true
+			columns = append(columns, col)
+		}
+	}
+
+	for _, field := range schema.requiredFields(self.Lenient) {
+		if field != FieldDstIP && field != FieldProto {
+			add(schema.Column(field))
+		}
+	}
+	for _, col := range self.GroupBy {
+		add(schema.Column(col))
+	}
+	if self.Metrics && !self.Lenient {
+		add(schema.Column(FieldDuration))
+	}
+
+	return columns
+}
+
+// schema returns schema of input. If schema isn't set, it returns
+// [DefaultSchema].
+func (self *Options) schema() *Schema {
+	if self.Schema == nil {
+		return DefaultSchema()
+	}
+	return self.Schema
+}
+
+// Columns is a list of .csv column names. As a CLI option it's a comma
+// separated list, like "Source.IP,Destination.Port".
+type Columns []string
+
+// String returns comma separated list of columns. It implements [flag.Value].
+func (self *Columns) String() string {
+	return strings.Join(*self, ",")
+}
+
+// Set parses comma separated list of columns from s. Columns can't be named
+// like our output columns of time, counters and metrics, see
+// [outHeaderRecord]. It implements [flag.Value].
+func (self *Columns) Set(s string) error {
+	columns := Columns{}
+	if s != "" {
+		columns = strings.Split(s, ",")
+	}
+
+	seen := make(map[string]bool, len(columns))
+	for i, col := range columns {
+		col = strings.TrimSpace(col)
+		if col == "" {
+			return fmt.Errorf("empty column name in %q", s)
+		} else if seen[col] {
+			return fmt.Errorf("duplicate column %q in %q", col, s)
+		} else if reservedColumn(col) {
+			return fmt.Errorf("column %q in %q is reserved for output", col, s)
+		}
+		seen[col] = true
+		columns[i] = col
+	}
+	*self = columns
+
+	return nil
+}
+
+// reservedColumn returns true if col is a name of our output column, which
+// isn't a group-by column.
+func reservedColumn(col string) bool {
+	switch col {
+	case "Timestamp", "Packets", "Bytes":
+		return true
+	}
+	for _, group := range metricGroups {
+		for _, m := range group {
+			if m.name == col {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Modes of handling of counter overflows
+const (
+	OverflowError    = "error"
+	OverflowSaturate = "saturate"
+)
+
+// ErrCounterOverflow means sum of counters doesn't fit into uint64
+var ErrCounterOverflow = errors.New("counter overflow")
+
+// Overflow defines what to do, when sum of counters doesn't fit into uint64.
+// Zero value means [OverflowError].
+type Overflow string
+
+// String returns name of the mode. It implements [flag.Value].
+func (self *Overflow) String() string {
+	if *self == "" {
+		return OverflowError
+	}
+	return string(*self)
+}
+
+// Set checks s is a known mode and assigns it. It implements [flag.Value].
+func (self *Overflow) Set(s string) error {
+	switch s {
+	case OverflowError, OverflowSaturate:
+		*self = Overflow(s)
+		return nil
+	}
+	return fmt.Errorf("unknown overflow mode %q, expected %s or %s",
+		s, OverflowError, OverflowSaturate)
+}
+
+// check returns err, unless it's [ErrCounterOverflow] and the mode allows
+// saturated counters.
+func (self Overflow) check(err error) error {
+	if self == OverflowSaturate && errors.Is(err, ErrCounterOverflow) {
+		return nil
+	}
+	return err
+}
+
+// addCounters returns a + b and false if it overflows uint64. In this case the
+// sum is saturated to math.MaxUint64.
+func addCounters(a, b uint64) (uint64, bool) {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64, false
+	}
+	return sum, true
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"math"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverflowSet(t *testing.T) {
+	assert := assert.New(t)
+
+	var overflow Overflow
+	assert.Equal(OverflowError, overflow.String())
+	assert.NoError(overflow.Set(OverflowSaturate))
+	assert.Equal(OverflowSaturate, overflow.String())
+	assert.Error(overflow.Set("wrap"))
+}
+
+func TestAddOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	rec := &CSVRecord{TimeID: "2017-04-26-11", Keys: []string{"10.0.0.1", "TCP"},
+		Packets: 1, Bytes: math.MaxUint64 - 1}
+	assert.NoError(rec.Add(&CSVRecord{Packets: 1, Bytes: 1}))
+	assert.Equal(uint64(math.MaxUint64), rec.Bytes)
+
+	err := rec.Add(&CSVRecord{Packets: 1, Bytes: 1})
+	assert.ErrorIs(err, ErrCounterOverflow)
+	assert.EqualError(err, "counter overflow: Bytes of 2017-04-26-11,10.0.0.1,TCP")
+	assert.Equal(uint64(math.MaxUint64), rec.Bytes, "saturated")
+	assert.Equal(uint64(3), rec.Packets)
+
+	var overflow Overflow
+	assert.ErrorIs(overflow.check(err), ErrCounterOverflow)
+	overflow = OverflowSaturate
+	assert.NoError(overflow.check(err))
+}
+
+func TestAddOverflowMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := NewOptions()
+	opts.Directional = true
+	opts.Metrics = true
+	makeRecord := func(bytes uint64, duration uint64) *CSVRecord {
+		rec := &CSVRecord{TimeID: "2017-04-26-11",
+			Keys: []string{"10.0.0.1", "TCP"}, Packets: 2, Bytes: bytes}
+		rec.setMetrics(opts.metrics())
+		// FwdPackets, BwdPackets, FwdBytes, BwdBytes, Flows, DurationMin,
+		// DurationMax, DurationSum, FirstSeen, LastSeen
+		copy(rec.Metrics, []uint64{1, 1, bytes, 0, 1, duration, duration,
+			duration, duration, duration})
+		rec.updateDerived()
+		return rec
+	}
+
+	rec := makeRecord(math.MaxUint64, 5)
+	err := rec.Add(makeRecord(10, 7))
+	assert.ErrorIs(err, ErrCounterOverflow)
+	assert.EqualError(err, "counter overflow: Bytes of 2017-04-26-11,10.0.0.1,TCP")
+	assert.Equal([]uint64{2, 2, math.MaxUint64, 0, 2, 5, 7, 12, 5, 7,
+		math.MaxUint64 / 4}, rec.Metrics)
+}
+
+func TestExtractCountersOverflow(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	h := CSVHeader{"Total.Fwd.Packets": 0, "Total.Backward.Packets": 1}
+	rec := &CSVRecord{h: h}
+	got, err := rec.extractCounters([]string{"18446744073709551615", "1"},
+		"Total.Fwd.Packets", "Total.Backward.Packets")
+	require.ErrorIs(err, ErrCounterOverflow)
+	assert.Equal(uint64(math.MaxUint64), got)
+
+	// Single value above uint64 is saturated like a sum
+	for _, record := range [][]string{
+		{"99999999999999999999", "1"}, {"1", "1e20"},
+	} {
+		got, err = rec.extractCounters(record,
+			"Total.Fwd.Packets", "Total.Backward.Packets")
+		require.ErrorIs(err, ErrCounterOverflow, record)
+		assert.Equal(uint64(math.MaxUint64), got, record)
+	}
+
+	_, err = rec.extractCounters([]string{"1e20", "-1"},
+		"Total.Fwd.Packets", "Total.Backward.Packets")
+	assert.Error(err)
+	assert.NotErrorIs(err, ErrCounterOverflow)
+}
+
+func TestSpillerOverflow(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	makeRecords := func() []*CSVRecord {
+		records := makeSpillRecords(2)
+		records[0].Packets = 1
+		records[1] = &CSVRecord{TimeID: records[0].TimeID, ID: records[0].ID,
+			Keys: records[0].Keys, Packets: math.MaxUint64, Bytes: 1}
+		return records
+	}
+
+	// Every record is spilled, so the overflow happens on merge
+	for _, limit := range []ByteSize{1, 256 << 20} {
+		spiller := NewSpiller(t.TempDir(), limit, 1, NewOptions())
+		records := makeRecords()
+		err := spiller.Add(records[0])
+		if err == nil {
+			err = spiller.Add(records[1])
+		}
+		if err == nil {
+			err = spiller.Commit(newMemSink())
+		}
+		assert.ErrorIs(err, ErrCounterOverflow, limit)
+		require.NoError(spiller.Close())
+
+		opts := NewOptions()
+		require.NoError(opts.Overflow.Set(OverflowSaturate))
+		spiller = NewSpiller(t.TempDir(), limit, 1, opts)
+		for _, rec := range makeRecords() {
+			require.NoError(spiller.Add(rec))
+		}
+		sink := newMemSink()
+		require.NoError(spiller.Commit(sink))
+		require.NoError(spiller.Close())
+		rec := sink.data[records[0].TimeID][records[0].ID]
+		assert.Equal(uint64(math.MaxUint64), rec.Packets, limit)
+	}
+}
+
+func TestSQLiteSinkOverflow(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	netflow, err := makeTestRecordCompact()
+	require.NoError(err)
+	netflow.Packets = math.MaxInt64 - 1
+
+	fname := path.Join(t.TempDir(), "flows.db")
+	sink, err := NewSQLiteSink(fname, NewOptions())
+	require.NoError(err)
+	require.NoError(sink.WriteHour(netflow.TimeID, HourData{netflow.ID: netflow}))
+	err = sink.WriteHour(netflow.TimeID, HourData{netflow.ID: netflow})
+	assert.ErrorIs(err, ErrCounterOverflow)
+	netflow.Packets = math.MaxUint64
+	err = sink.WriteHour("2017-04-26-12", HourData{netflow.ID: netflow})
+	assert.ErrorIs(err, ErrCounterOverflow)
+	require.NoError(sink.Close())
+
+	opts := NewOptions()
+	require.NoError(opts.Overflow.Set(OverflowSaturate))
+	sink, err = NewSQLiteSink(fname, opts)
+	require.NoError(err)
+	defer sink.Close()
+	require.NoError(sink.WriteHour(netflow.TimeID, HourData{netflow.ID: netflow}))
+
+	var packets int64
+	require.NoError(sink.db.QueryRow("SELECT packets FROM flows").Scan(&packets))
+	assert.Equal(int64(math.MaxInt64), packets)
+}
@@ -0,0 +1,202 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+// parquetColumns are column indexes of our output columns in Parquet file
+type parquetColumns []int
+
+// newParquetSchema returns Parquet schema for our output columns and indexes of
+// the columns in it. Timestamp is TIMESTAMP, counters are UINT64 and the rest
+// columns are strings.
+func newParquetSchema(opts *Options) (*parquet.Schema, parquetColumns) {
+	header := outHeaderRecord(opts)
+	numStart := 1 + len(opts.GroupBy)
+
+	group := make(parquet.Group, len(header))
+	for i, col := range header {
+		switch {
+		case i == 0:
+			group[col] = parquet.Timestamp(parquet.Millisecond)
+		case i >= numStart:
+			group[col] = parquet.Uint(64)
+		default:
+			group[col] = parquet.String()
+		}
+	}
+	schema := parquet.NewSchema("netflow", group)
+
+	// Parquet sorts columns of group by name, so we need to know where every
+	// our column is.
+	columns := make(parquetColumns, len(header))
+	for i, col := range header {
+		leaf, _ := schema.Lookup(col)
+		columns[i] = leaf.ColumnIndex
+	}
+
+	return schema, columns
+}
+
+// parquetRowGroupRows is max num of rows in row group of Parquet file. Writer
+// keeps the whole row group in memory, so it limits memory of large files.
+const parquetRowGroupRows = 64 << 10
+
+// parquetCodecs maps our compression algorithms to Parquet codecs. Parquet
+// compresses its pages itself, so we never compress Parquet files as a whole.
+var parquetCodecs = map[Compression]compress.Codec{
+	CompressNone: &parquet.Uncompressed,
+	CompressGzip: &parquet.Gzip,
+	CompressZstd: &parquet.Zstd,
+}
+
+// newParquetWriter returns initialized [*parquetWriter]
+func newParquetWriter(w io.Writer, opts *Options) *parquetWriter {
+	schema, columns := newParquetSchema(opts)
+	return &parquetWriter{
+		w: parquet.NewWriter(w, schema,
+			parquet.Compression(parquetCodecs[opts.Compress]),
+			parquet.MaxRowsPerRowGroup(parquetRowGroupRows)),
+		columns:  columns,
+		numStart: 1 + len(opts.GroupBy),
+		bucket:   opts.Bucket,
+		counters: make([]uint64, 0, 2+len(opts.metrics())),
+	}
+}
+
+// parquetWriter writes aggregated data as Parquet file. All data of one file
+// must be written by one writer, because Parquet file can't be appended.
+type parquetWriter struct {
+	w        *parquet.Writer
+	columns  parquetColumns // indexes of our output columns
+	numStart int            // index of the first numeric column
+	bucket   Bucket         // for converting time ID back to time
+	counters []uint64       // reusable buffer for numeric columns of one row
+}
+
+// WriteHeader does nothing, Parquet writes its schema in the footer of file
+func (self *parquetWriter) WriteHeader() error {
+	return nil
+}
+
+func (self *parquetWriter) Write(rec *CSVRecord) error {
+	t, err := self.bucket.ParseTimeID(rec.TimeID)
+	if err != nil {
+		return err
+	}
+
+	row := make(parquet.Row, len(self.columns))
+	row[self.columns[0]] = parquet.Int64Value(t.UnixMilli())
+	for i, key := range rec.Keys {
+		row[self.columns[1+i]] = parquet.ByteArrayValue([]byte(key))
+	}
+	self.counters = append(self.counters[:0], rec.Packets, rec.Bytes)
+	self.counters = append(self.counters, rec.Metrics...)
+	for i, n := range self.counters {
+		row[self.columns[self.numStart+i]] = parquet.Int64Value(int64(n))
+	}
+	for col, v := range row {
+		row[col] = v.Level(0, 0, col)
+	}
+
+	_, err = self.w.WriteRows([]parquet.Row{row})
+	return err
+}
+
+// Close writes buffered rows and the footer of Parquet file
+func (self *parquetWriter) Close() error {
+	return self.w.Close()
+}
+
+// newParquetReader returns initialized [*parquetReader]. Parquet needs random
+// access to the file, so it reads r into memory, unless r is a file.
+func newParquetReader(r io.Reader, opts *Options) (*parquetReader, error) {
+	f, err := openParquet(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header := outHeaderRecord(opts)
+	columns := make(parquetColumns, len(header))
+	for i, col := range header {
+		leaf, present := f.Schema().Lookup(col)
+		if !present {
+			return nil, fmt.Errorf("parquet: missing column %q", col)
+		}
+		columns[i] = leaf.ColumnIndex
+	}
+
+	return &parquetReader{
+		r:        parquet.NewReader(f),
+		columns:  columns,
+		numStart: 1 + len(opts.GroupBy),
+		bucket:   opts.Bucket,
+		metrics:  opts.metrics(),
+		rows:     make([]parquet.Row, 1),
+	}, nil
+}
+
+// openParquet opens Parquet file of r, reading it on demand, if r is a file
+func openParquet(r io.Reader) (*parquet.File, error) {
+	if f, ok := r.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return parquet.OpenFile(f, info.Size())
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parquet.OpenFile(bytes.NewReader(b), int64(len(b)))
+}
+
+// parquetReader reads aggregated data, written by [parquetWriter]
+type parquetReader struct {
+	r        *parquet.Reader
+	columns  parquetColumns // indexes of our output columns
+	numStart int            // index of the first numeric column
+	bucket   Bucket         // for converting time back to time ID
+	metrics  []metric       // metrics after counters
+	rows     []parquet.Row  // reusable buffer for one row
+}
+
+func (self *parquetReader) Read() (*CSVRecord, error) {
+	n, err := self.r.ReadRows(self.rows)
+	if n == 0 {
+		if err == io.EOF {
+			return nil, nil
+		} else if err == nil {
+			err = io.ErrNoProgress
+		}
+		return nil, err
+	}
+
+	row := self.rows[0]
+	rec := &CSVRecord{
+		TimeID: self.bucket.TimeID(
+			time.UnixMilli(row[self.columns[0]].Int64()).UTC()),
+		Keys: make([]string, self.numStart-1),
+	}
+	for i := range rec.Keys {
+		rec.Keys[i] = string(row[self.columns[1+i]].ByteArray())
+	}
+	rec.ID = rec.genUniqID()
+	rec.Packets = uint64(row[self.columns[self.numStart]].Int64())
+	rec.Bytes = uint64(row[self.columns[self.numStart+1]].Int64())
+	rec.setMetrics(self.metrics)
+	for i := range rec.Metrics {
+		rec.Metrics[i] = uint64(row[self.columns[self.numStart+2+i]].Int64())
+	}
+
+	return rec, nil
+}
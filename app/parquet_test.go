@@ -0,0 +1,89 @@
+package app
+
+import (
+	"bytes"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParquetWriter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rec, err := makeTestRecord()
+	require.NoError(err)
+
+	for _, compress := range []string{CompressNone, CompressZstd} {
+		opts := NewOptions()
+		require.NoError(opts.Format.Set(FormatParquet))
+		require.NoError(opts.Compress.Set(compress))
+		assert.Equal(".parquet", opts.OutExt())
+
+		b := new(bytes.Buffer)
+		w := NewRecordWriter(b, opts)
+		require.NoError(w.WriteHeader())
+		require.NoError(w.Write(rec))
+		require.NoError(w.Close())
+
+		r, err := NewRecordReader(b, opts)
+		require.NoError(err)
+		got, err := r.Read()
+		require.NoError(err)
+		assert.Equal(rec.TimeID, got.TimeID)
+		assert.Equal(rec.Keys, got.Keys)
+		assert.Equal(rec.ID, got.ID)
+		assert.Equal(rec.Packets, got.Packets)
+		assert.Equal(rec.Bytes, got.Bytes)
+
+		got, err = r.Read()
+		require.NoError(err)
+		assert.Nil(got)
+	}
+}
+
+func TestParquetReaderMissingColumn(t *testing.T) {
+	opts := NewOptions()
+	require.NoError(t, opts.Format.Set(FormatParquet))
+
+	b := new(bytes.Buffer)
+	w := NewRecordWriter(b, opts)
+	require.NoError(t, w.Close())
+
+	require.NoError(t, opts.GroupBy.Set("Source.IP"))
+	_, err := NewRecordReader(b, opts)
+	assert.Error(t, err)
+}
+
+func TestOutDirWriteHourParquet(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	netflow, err := makeTestRecordCompact()
+	require.NoError(err)
+
+	opts := NewOptions()
+	require.NoError(opts.Format.Set(FormatParquet))
+
+	// The second write adds data to data of the file
+	outPath := t.TempDir()
+	sink := NewOutDir(outPath, t.TempDir(), opts)
+	for i := 0; i < 2; i++ {
+		data := HourData{netflow.ID: &CSVRecord{
+			TimeID:  netflow.TimeID,
+			ID:      netflow.ID,
+			Keys:    netflow.Keys,
+			Packets: netflow.Packets,
+			Bytes:   netflow.Bytes,
+		}}
+		require.NoError(sink.WriteHour(netflow.TimeID, data))
+	}
+
+	data, err := loadHourFile(path.Join(outPath, netflow.TimeID+".parquet"), opts)
+	require.NoError(err)
+	require.Contains(data, netflow.ID)
+	assert.Equal(2*netflow.Packets, data[netflow.ID].Packets)
+	assert.Equal(2*netflow.Bytes, data[netflow.ID].Bytes)
+}
@@ -0,0 +1,293 @@
+package app
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// parseChunkSize is num of input lines, which one worker parses at once
+const parseChunkSize = 4096
+
+// ParseInput reads input .csv from r, parses it according to its own header
+// line and opts and passes every parsed line to add. Lines, which can't be
+// parsed, it passes to badRows. fname is a name of the input for reporting of
+// errors.
+//
+// If workers > 1, it parses lines by workers goroutines in parallel, and every
+// worker aggregates its chunk of lines, so add gets partially aggregated
+// records. 0 workers means GOMAXPROCS. In any case add is called from the
+// calling goroutine only, and badRows gets rejected lines in input order, so
+// aggregated data and rejected lines are the same for any num of workers.
+//
+// With opts.Approx it parses lines by chunks even with 1 worker, and add gets
+// records of every chunk in order of their keys. Chunks don't depend on num of
+// workers, so [Approx] gets the same sequence of records for any num of
+// workers.
+func ParseInput(
+	r io.Reader, fname string, opts *Options, workers int, badRows *BadRows,
+	add func(netflow *CSVRecord) error,
+) error {
+	cr := csv.NewReader(r)
+
+	// Every input has its own header line, so they can have different columns
+	// order or even different schemas.
+	h, opts, err := NewInputHeader(cr, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers == 1 && opts.Approx == 0 {
+		cr.ReuseRecord = true // Reuse some memory for performance
+		return parseInput(h, cr, fname, opts, badRows, add)
+	}
+	return newParallelParser(h, cr, fname, opts, workers).parse(badRows, add)
+}
+
+// parseInput parses lines of r one by one and passes them to add. Errors of add
+// it reports with name of input and line number, like [parallelParser] does.
+func parseInput(
+	h CSVHeader, r *csv.Reader, fname string, opts *Options, badRows *BadRows,
+	add func(netflow *CSVRecord) error,
+) error {
+	for {
+		netflow, err := NewRecord(h, r, opts)
+		if err != nil {
+			if err := badRows.Reject(withFile(err, fname)); err != nil {
+				return err
+			}
+			continue
+		} else if netflow == nil {
+			break
+		}
+
+		if err := add(netflow); err != nil {
+			line, _ := r.FieldPos(0)
+			return fmt.Errorf("%s: line %d: %w", fname, line, err)
+		}
+	}
+
+	return nil
+}
+
+// withFile sets name of input for err, if it's [*RowError], and returns err
+func withFile(err error, fname string) error {
+	var rowErr *RowError
+	if errors.As(err, &rowErr) {
+		rowErr.File = fname
+	}
+	return err
+}
+
+// newParallelParser returns initialized [*parallelParser], which parses lines
+// of r by workers goroutines.
+func newParallelParser(
+	h CSVHeader, r *csv.Reader, fname string, opts *Options, workers int,
+) *parallelParser {
+	return &parallelParser{
+		h:       h,
+		r:       r,
+		fname:   fname,
+		opts:    opts,
+		workers: workers,
+		chunks:  make(chan *parseChunk, workers),
+		results: make(chan *parseChunk, workers),
+		done:    make(chan struct{}),
+	}
+}
+
+// parallelParser parses input by pipeline: one goroutine reads lines of input
+// and splits them into chunks, workers goroutines parse and aggregate chunks,
+// and the calling goroutine merges results in input order.
+type parallelParser struct {
+	h       CSVHeader
+	r       *csv.Reader
+	fname   string   // name of input
+	opts    *Options // settings of parsing for this input
+	workers int      // num of parsing goroutines
+
+	chunks  chan *parseChunk // read chunks for workers
+	results chan *parseChunk // parsed chunks for merging
+	done    chan struct{}    // closed when merging stopped
+	wg      sync.WaitGroup
+}
+
+// parseChunk is a chunk of input lines and result of its parsing
+type parseChunk struct {
+	seq     int          // sequence num of the chunk in input
+	records [][]string   // lines of the chunk
+	lines   []int        // line numbers of records
+	bad     []error      // errors of lines, which can't be parsed, in input order
+	rows    []*CSVRecord // aggregated data of parsed lines, see parseChunk
+	err     error        // fatal error of reading, after the lines of this chunk
+}
+
+// parse runs the pipeline, passes aggregated data of every chunk to add and
+// rejected lines to badRows. It returns after every goroutine stopped.
+func (self *parallelParser) parse(
+	badRows *BadRows, add func(netflow *CSVRecord) error,
+) error {
+	self.wg.Add(1 + self.workers)
+	go self.read()
+	for i := 0; i < self.workers; i++ {
+		go self.work()
+	}
+	go func() {
+		self.wg.Wait()
+		close(self.results)
+	}()
+	// Stop every goroutine on return and wait for them, because caller closes
+	// input after that.
+	defer func() {
+		close(self.done)
+		for range self.results {
+		}
+	}()
+
+	// Workers finish chunks in any order, so we keep early ones here until
+	// their turn.
+	pending := make(map[int]*parseChunk)
+	next := 0
+	for chunk := range self.results {
+		pending[chunk.seq] = chunk
+		for chunk := pending[next]; chunk != nil; chunk = pending[next] {
+			delete(pending, next)
+			next++
+			if err := self.merge(chunk, badRows, add); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// merge passes rejected lines of chunk to badRows and its aggregated data to
+// add.
+func (self *parallelParser) merge(
+	chunk *parseChunk, badRows *BadRows, add func(netflow *CSVRecord) error,
+) error {
+	for _, err := range chunk.bad {
+		if err := badRows.Reject(err); err != nil {
+			return err
+		}
+	}
+
+	for _, netflow := range chunk.rows {
+		if err := add(netflow); err != nil {
+			return err
+		}
+	}
+
+	return chunk.err
+}
+
+// read reads lines of input and sends them to workers by chunks. Lines, which
+// can't be read, it passes as rejected ones.
+func (self *parallelParser) read() {
+	defer self.wg.Done()
+	defer close(self.chunks)
+
+	for seq := 0; ; seq++ {
+		chunk := &parseChunk{
+			seq:     seq,
+			records: make([][]string, 0, parseChunkSize),
+			lines:   make([]int, 0, parseChunkSize),
+		}
+		eof := false
+		for len(chunk.records) < parseChunkSize {
+			record, err := self.r.Read()
+			if err == io.EOF {
+				eof = true
+				break
+			} else if err != nil {
+				err = newReadError(err, record)
+				var rowErr *RowError
+				if !errors.As(err, &rowErr) {
+					chunk.err, eof = err, true
+					break
+				}
+				// Keep the error in place of the line, so rejected lines are in
+				// input order.
+				chunk.records = append(chunk.records, nil)
+				chunk.lines = append(chunk.lines, 0)
+				chunk.bad = append(chunk.bad, withFile(err, self.fname))
+				continue
+			}
+			line, _ := self.r.FieldPos(0)
+			chunk.records = append(chunk.records, record)
+			chunk.lines = append(chunk.lines, line)
+		}
+
+		select {
+		case self.chunks <- chunk:
+		case <-self.done:
+			return
+		}
+		if eof {
+			return
+		}
+	}
+}
+
+// work parses and aggregates chunks of lines
+func (self *parallelParser) work() {
+	defer self.wg.Done()
+
+	for chunk := range self.chunks {
+		self.parseChunk(chunk)
+		select {
+		case self.results <- chunk:
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// parseChunk parses and aggregates lines of chunk. It merges errors of lines,
+// which can't be parsed, with errors of lines, which can't be read, keeping
+// input order.
+//
+// Order of aggregated records doesn't matter for exact aggregation, but
+// [Approx] depends on it, so for approximate aggregation it sorts them by key,
+// instead of random order of map, and it gives the same result every run.
+func (self *parallelParser) parseChunk(chunk *parseChunk) {
+	readErrs := chunk.bad
+	chunk.bad = nil
+	data := make(HourData)
+
+	for i, record := range chunk.records {
+		if record == nil {
+			chunk.bad = append(chunk.bad, readErrs[0])
+			readErrs = readErrs[1:]
+			continue
+		}
+
+		netflow, err := ParseRecord(self.h, record, chunk.lines[i], self.opts)
+		if err != nil {
+			chunk.bad = append(chunk.bad, withFile(err, self.fname))
+			continue
+		}
+		if err := self.opts.Overflow.check(data.Add(netflow)); err != nil {
+			// Lines after this one don't matter, we can't continue anyway
+			chunk.err = fmt.Errorf("%s: line %d: %w", self.fname, chunk.lines[i], err)
+			break
+		}
+	}
+	chunk.records, chunk.lines = nil, nil
+
+	if self.opts.Approx > 0 {
+		chunk.rows = SortOrder(SortKey).Sorted(data)
+		return
+	}
+	chunk.rows = make([]*CSVRecord, 0, len(data))
+	for _, netflow := range data {
+		chunk.rows = append(chunk.rows, netflow)
+	}
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeParseInput returns nfdump .csv with n lines of a few keys and hours. Every
+// 1000th line has bad counter and every 1500th line has wrong field count.
+func makeParseInput(n int) string {
+	var b strings.Builder
+	b.WriteString("ts,da,pr,ipkt,opkt,ibyt,obyt\n")
+	for i := 0; i < n; i++ {
+		counter := fmt.Sprint(i)
+		if i%1000 == 999 {
+			counter = "x"
+		}
+		fmt.Fprintf(&b, "2017-04-26 %02d:00:00,10.0.0.%d,TCP,%s,1,%d,2",
+			10+i%3, i%7, counter, i)
+		if i%1500 == 1499 {
+			b.WriteString(",extra")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func TestParseInput(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	input := makeParseInput(3*parseChunkSize + 100)
+	var want HourData
+	var wantBad []byte
+	for _, workers := range []int{1, 4, 0} {
+		badName := path.Join(t.TempDir(), "bad.csv")
+		badRows, err := NewBadRows(badName, 0)
+		require.NoError(err)
+
+		data := make(HourData)
+		err = ParseInput(strings.NewReader(input), "in.csv", NewOptions(),
+			workers, badRows, func(netflow *CSVRecord) error {
+				data.Add(netflow)
+				return nil
+			})
+		require.NoError(err)
+		require.NoError(badRows.Close())
+		bad, err := os.ReadFile(badName)
+		require.NoError(err)
+
+		if want == nil {
+			want, wantBad = data, bad
+			assert.Len(want, 21)
+			assert.Equal(16, badRows.Count())
+			continue
+		}
+
+		require.Len(data, len(want), workers)
+		for id, netflow := range want {
+			require.Contains(data, id)
+			assert.Equal(netflow.Packets, data[id].Packets, workers)
+			assert.Equal(netflow.Bytes, data[id].Bytes, workers)
+		}
+		assert.Equal(string(wantBad), string(bad), workers)
+	}
+}
+
+func TestParseInputTooManyErrors(t *testing.T) {
+	badRows, err := NewBadRows(path.Join(t.TempDir(), "bad.csv"), 3)
+	require.NoError(t, err)
+	defer badRows.Close()
+
+	input := makeParseInput(3*parseChunkSize + 100)
+	err = ParseInput(strings.NewReader(input), "in.csv", NewOptions(), 4,
+		badRows, func(netflow *CSVRecord) error { return nil })
+	assert.ErrorContains(t, err, "too many bad rows")
+}
+
+func TestParseInputOverflow(t *testing.T) {
+	input := "ts,da,pr,ipkt,opkt,ibyt,obyt\n" +
+		"2017-04-26 10:00:00,10.0.0.1,TCP,18446744073709551615,0,1,1\n" +
+		"2017-04-26 10:00:00,10.0.0.1,TCP,1,0,1,1\n"
+
+	var wantErr string
+	for _, workers := range []int{1, 4} {
+		badRows, err := NewBadRows("", 0)
+		require.NoError(t, err)
+
+		data := make(HourData)
+		opts := NewOptions()
+		add := func(netflow *CSVRecord) error {
+			return opts.Overflow.check(data.Add(netflow))
+		}
+		err = ParseInput(strings.NewReader(input), "in.csv", opts, workers,
+			badRows, add)
+		assert.ErrorIs(t, err, ErrCounterOverflow, workers)
+		assert.ErrorContains(t, err, "in.csv: line 3: ", workers)
+		// Sequential and parallel parsing report the same error
+		if wantErr == "" {
+			wantErr = err.Error()
+		}
+		assert.EqualError(t, err, wantErr, workers)
+
+		require.NoError(t, opts.Overflow.Set(OverflowSaturate))
+		data = make(HourData)
+		err = ParseInput(strings.NewReader(input), "in.csv", opts, workers,
+			badRows, add)
+		require.NoError(t, err, workers)
+		for _, netflow := range data {
+			assert.Equal(t, uint64(math.MaxUint64), netflow.Packets, workers)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package app
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// mergeFanIn is max num of sorted runs we merge at once. It limits num of open
+// files, more runs are merged in a few passes.
+const mergeFanIn = 64
+
+// stagingDir is a private dir for temporary files, created on demand in parent
+// dir (default dir for temporary files if it's empty). It's safe for
+// concurrent use.
+type stagingDir struct {
+	parent string     // parent dir of staging dir
+	opts   *Options   // settings of run files
+	dir    string     // staging dir, empty until created
+	n      int        // num of created files, for naming of new ones
+	mu     sync.Mutex // protects dir and n
+}
+
+// create creates new file in staging dir, named by prefix
+func (self *stagingDir) create(prefix string) (*os.File, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.dir == "" {
+		dir, err := os.MkdirTemp(self.parent, "fc-staging-")
+		if err != nil {
+			return nil, err
+		}
+		self.dir = dir
+	}
+
+	fname := path.Join(self.dir,
+		fmt.Sprintf("%s-%06d%s", prefix, self.n, self.opts.OutExt()))
+	self.n++
+
+	return os.Create(fname)
+}
+
+// writeRun creates new run file in staging dir and writes records into it by
+// write. It returns name of the file.
+func (self *stagingDir) writeRun(
+	write func(w RecordWriter) error,
+) (string, error) {
+	f, err := self.create("run")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	w := NewRecordWriter(f, self.opts)
+	if err := w.WriteHeader(); err != nil {
+		return "", err
+	}
+	if err := write(w); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return f.Name(), f.Close()
+}
+
+// reduceRuns merges run files runs, sorted in order, until there are at most
+// mergeFanIn of them, so they can be merged at once. It returns names of the
+// rest runs.
+func (self *stagingDir) reduceRuns(
+	runs []string, order SortOrder,
+) ([]string, error) {
+	for len(runs) > mergeFanIn {
+		merged := runs[:mergeFanIn]
+		fname, err := self.writeRun(func(w RecordWriter) error {
+			return mergeRuns(merged, self.opts, order, w.Write)
+		})
+		if err != nil {
+			return runs, err
+		}
+		for _, run := range merged {
+			if err := os.Remove(run); err != nil {
+				return runs, err
+			}
+		}
+		runs = append(runs[mergeFanIn:], fname)
+	}
+	return runs, nil
+}
+
+// Remove removes staging dir with every file, if it was created
+func (self *stagingDir) Remove() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(self.dir)
+}
+
+// newRunSorter returns initialized [*runSorter], which sorts records in order
+// and spills them into stage, when estimated size of records reaches limit.
+func newRunSorter(stage *stagingDir, order SortOrder, limit int64) *runSorter {
+	return &runSorter{stage: stage, order: order, limit: limit}
+}
+
+// runSorter is an external sort of aggregated records. While records fit into
+// memory limit, it sorts them in memory. Otherwise it spills them by sorted
+// runs into staging dir and merges the runs.
+type runSorter struct {
+	stage   *stagingDir  // dir for run files
+	order   SortOrder    // order of records
+	limit   int64        // memory limit in bytes
+	records []*CSVRecord // records, which aren't spilled yet
+	size    int64        // estimated size of records in bytes
+	runs    []string     // names of run files
+}
+
+// Add adds netflow. It spills records, when memory limit reached.
+func (self *runSorter) Add(netflow *CSVRecord) error {
+	self.records = append(self.records, netflow)
+	self.size += recordSize(netflow)
+
+	if self.size >= self.limit {
+		return self.spill()
+	}
+	return nil
+}
+
+// spill writes records into new run file in order and resets them
+func (self *runSorter) spill() error {
+	self.sort()
+	fname, err := self.stage.writeRun(func(w RecordWriter) error {
+		for _, netflow := range self.records {
+			if err := w.Write(netflow); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	self.runs = append(self.runs, fname)
+	self.records = nil
+	self.size = 0
+
+	return nil
+}
+
+// sort sorts records in memory
+func (self *runSorter) sort() {
+	sort.Slice(self.records, func(i, j int) bool {
+		return self.order.less(self.records[i], self.records[j])
+	})
+}
+
+// Sorted passes every record to emit in order and removes run files. Records
+// with equal uniq ID are aggregated, if order brings them together, like
+// [SortKey] does.
+func (self *runSorter) Sorted(emit func(netflow *CSVRecord) error) error {
+	defer self.remove()
+
+	if len(self.runs) == 0 {
+		self.sort()
+		return aggregateSorted(
+			recordRows(self.records), self.stage.opts.Overflow, emit)
+	}
+
+	if len(self.records) > 0 {
+		if err := self.spill(); err != nil {
+			return err
+		}
+	}
+	runs, err := self.stage.reduceRuns(self.runs, self.order)
+	self.runs = runs
+	if err != nil {
+		return err
+	}
+
+	return mergeRuns(self.runs, self.stage.opts, self.order, emit)
+}
+
+// remove removes run files and forgets every record
+func (self *runSorter) remove() {
+	for _, run := range self.runs {
+		os.Remove(run)
+	}
+	self.runs, self.records, self.size = nil, nil, 0
+}
+
+// rowSource passes every row it has to emit, until emit fails
+type rowSource func(emit func(netflow *CSVRecord) error) error
+
+// recordRows returns source of records in their order
+func recordRows(records []*CSVRecord) rowSource {
+	return func(emit func(netflow *CSVRecord) error) error {
+		for _, netflow := range records {
+			if err := emit(netflow); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// aggregateSorted passes rows of src to emit, aggregating adjacent rows with
+// equal uniq ID.
+func aggregateSorted(
+	src rowSource, overflow Overflow, emit func(netflow *CSVRecord) error,
+) error {
+	var cur *CSVRecord
+	err := src(func(netflow *CSVRecord) error {
+		if cur != nil && cur.ID == netflow.ID {
+			return overflow.check(cur.Add(netflow))
+		}
+		if cur != nil {
+			if err := emit(cur); err != nil {
+				return err
+			}
+		}
+		cur = netflow
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if cur != nil {
+		return emit(cur)
+	}
+	return nil
+}
+
+// mergeRuns reads run files runs, written with opts, and passes aggregated
+// records to emit in order. Every run must be sorted in order.
+func mergeRuns(
+	runs []string, opts *Options, order SortOrder,
+	emit func(netflow *CSVRecord) error,
+) error {
+	h := &runHeap{order: order, heads: make([]*runHead, 0, len(runs))}
+	for _, fname := range runs {
+		f, err := OpenInput(fname)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r, err := NewRecordReader(f, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fname, err)
+		}
+		netflow, err := r.Read()
+		if err != nil {
+			return fmt.Errorf("%s: %w", fname, err)
+		} else if netflow != nil {
+			h.heads = append(h.heads, &runHead{netflow: netflow, r: r})
+		}
+	}
+	heap.Init(h)
+
+	return aggregateSorted(func(emit func(netflow *CSVRecord) error) error {
+		for h.Len() > 0 {
+			head := h.heads[0]
+			if err := emit(head.netflow); err != nil {
+				return err
+			}
+
+			netflow, err := head.r.Read()
+			if err != nil {
+				return err
+			} else if netflow == nil {
+				heap.Pop(h)
+			} else {
+				head.netflow = netflow
+				heap.Fix(h, 0)
+			}
+		}
+		return nil
+	}, opts.Overflow, emit)
+}
+
+// runHead is the current record of run file
+type runHead struct {
+	netflow *CSVRecord   // current record
+	r       RecordReader // reader of the rest of run
+}
+
+// runHeap is a min-heap of run heads by order of current record
+type runHeap struct {
+	order SortOrder
+	heads []*runHead
+}
+
+func (self *runHeap) Len() int { return len(self.heads) }
+
+func (self *runHeap) Less(i, j int) bool {
+	return self.order.less(self.heads[i].netflow, self.heads[j].netflow)
+}
+
+func (self *runHeap) Swap(i, j int) {
+	self.heads[i], self.heads[j] = self.heads[j], self.heads[i]
+}
+
+func (self *runHeap) Push(x any) { self.heads = append(self.heads, x.(*runHead)) }
+
+func (self *runHeap) Pop() any {
+	head := self.heads[len(self.heads)-1]
+	self.heads = self.heads[:len(self.heads)-1]
+	return head
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSorter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := make(HourData)
+	for _, rec := range makeSpillRecords(200) {
+		require.NoError(data.Add(rec))
+	}
+
+	// 1 byte spills every row, so we get more than mergeFanIn runs
+	for _, order := range []SortOrder{SortKey, SortBytes, SortPackets} {
+		stage := &stagingDir{parent: t.TempDir(), opts: NewOptions()}
+		sorter := newRunSorter(stage, order, 1)
+		for _, rec := range data {
+			require.NoError(sorter.Add(rec))
+		}
+		require.Greater(len(sorter.runs), mergeFanIn)
+
+		var got []string
+		require.NoError(sorter.Sorted(func(netflow *CSVRecord) error {
+			got = append(got, netflow.ID)
+			return nil
+		}))
+
+		var want []string
+		for _, netflow := range order.Sorted(data) {
+			want = append(want, netflow.ID)
+		}
+		assert.Equal(want, got, order)
+		assert.Empty(sorter.runs, order)
+		require.NoError(stage.Remove())
+	}
+}
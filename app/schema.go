@@ -0,0 +1,296 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Logical fields of input flow records. [Schema] maps them onto actual columns
+// of input .csv.
+const (
+	FieldTimestamp  = "timestamp"   // when the flow began
+	FieldDstIP      = "dst_ip"      // destination IP
+	FieldProto      = "proto"       // protocol name
+	FieldFwdPackets = "fwd_packets" // num of packets from source to destination
+	FieldBwdPackets = "bwd_packets" // num of packets from destination to source
+	FieldFwdBytes   = "fwd_bytes"   // num of bytes from source to destination
+	FieldBwdBytes   = "bwd_bytes"   // num of bytes from destination to source
+	FieldDuration   = "duration"    // how long the flow lasted, optional
+)
+
+// logicalFields lists every logical field, which [Schema] must map. Optional
+// fields are needed for additional metrics only.
+var logicalFields = []string{
+	FieldTimestamp,
+	FieldDstIP,
+	FieldProto,
+	FieldFwdPackets,
+	FieldBwdPackets,
+	FieldFwdBytes,
+	FieldBwdBytes,
+}
+
+// counterFields lists logical fields, which are counters. In lenient mode
+// input can miss them.
+var counterFields = map[string]bool{
+	FieldFwdPackets: true,
+	FieldBwdPackets: true,
+	FieldFwdBytes:   true,
+	FieldBwdBytes:   true,
+}
+
+// outFields maps column names of our output onto logical fields. So group-by
+// column "Destination.IP" means destination IP for any schema.
+var outFields = map[string]string{
+	"Timestamp":      FieldTimestamp,
+	"Destination.IP": FieldDstIP,
+	"ProtocolName":   FieldProto,
+}
+
+// UnixTimeLayout is a special time layout for timestamps in seconds since Unix
+// epoch, like "1331901000.000000".
+const UnixTimeLayout = "unix"
+
+// Schema describes columns of input .csv file. It maps logical fields, like
+// [FieldDstIP], onto column names and defines layout of timestamps.
+type Schema struct {
+	Name         string            `yaml:"name"`          // name of the profile
+	TimeLayout   string            `yaml:"time_layout"`   // layout for time.Parse or "unix"
+	DurationUnit string            `yaml:"duration_unit"` // s, ms or us, s by default
+	Fields       map[string]string `yaml:"fields"`        // logical field -> column
+}
+
+// durationUnits maps units of duration onto num of microseconds
+var durationUnits = map[string]float64{
+	"":   1e6,
+	"s":  1e6,
+	"ms": 1e3,
+	"us": 1,
+}
+
+// Built-in schema profiles. The first one is the default, because we started
+// with it.
+var builtinSchemas = []*Schema{
+	{
+		Name:         "cicflowmeter",
+		TimeLayout:   "2/01/200615:04:05",
+		DurationUnit: "us",
+		Fields: map[string]string{
+			FieldTimestamp:  "Timestamp",
+			FieldDstIP:      "Destination.IP",
+			FieldProto:      "ProtocolName",
+			FieldFwdPackets: "Total.Fwd.Packets",
+			FieldBwdPackets: "Total.Backward.Packets",
+			FieldFwdBytes:   "Total.Length.of.Fwd.Packets",
+			FieldBwdBytes:   "Total.Length.of.Bwd.Packets",
+			FieldDuration:   "Flow.Duration",
+		},
+	},
+	{
+		Name:         "nfdump",
+		TimeLayout:   "2006-01-02 15:04:05",
+		DurationUnit: "s",
+		Fields: map[string]string{
+			FieldTimestamp:  "ts",
+			FieldDstIP:      "da",
+			FieldProto:      "pr",
+			FieldFwdPackets: "ipkt",
+			FieldBwdPackets: "opkt",
+			FieldFwdBytes:   "ibyt",
+			FieldBwdBytes:   "obyt",
+			FieldDuration:   "td",
+		},
+	},
+	{
+		Name:         "zeek",
+		TimeLayout:   UnixTimeLayout,
+		DurationUnit: "s",
+		Fields: map[string]string{
+			FieldTimestamp:  "ts",
+			FieldDstIP:      "id.resp_h",
+			FieldProto:      "proto",
+			FieldFwdPackets: "orig_pkts",
+			FieldBwdPackets: "resp_pkts",
+			FieldFwdBytes:   "orig_ip_bytes",
+			FieldBwdBytes:   "resp_ip_bytes",
+			FieldDuration:   "duration",
+		},
+	},
+}
+
+// DefaultSchema returns schema profile of CICFlowMeter
+func DefaultSchema() *Schema {
+	return builtinSchemas[0]
+}
+
+// AutoSchema is a name of schema, which means detect it from header of input
+const AutoSchema = "auto"
+
+// LoadSchema returns built-in schema profile by its name or loads it from YAML
+// or JSON file named s. It returns nil schema for [AutoSchema]. The file looks
+// like
+//
+//	name: myexport
+//	time_layout: "2006-01-02 15:04:05"
+//	duration_unit: ms
+//	fields:
+//	  timestamp: start
+//	  dst_ip: dst
+//	  ...
+func LoadSchema(s string) (*Schema, error) {
+	if s == AutoSchema {
+		return nil, nil
+	}
+
+	for _, schema := range builtinSchemas {
+		if schema.Name == s {
+			return schema, nil
+		}
+	}
+
+	// YAML is a superset of JSON, so we can parse both of them by yaml.
+	b, err := os.ReadFile(s)
+	if err != nil {
+		return nil, fmt.Errorf("unknown schema %q: %w", s, err)
+	}
+	schema := new(Schema)
+	if err := yaml.Unmarshal(b, schema); err != nil {
+		return nil, fmt.Errorf("schema %q: %w", s, err)
+	}
+	if schema.Name == "" {
+		schema.Name = s
+	}
+	if err := schema.validate(); err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+// SchemaNames returns names of built-in schema profiles
+func SchemaNames() []string {
+	names := make([]string, len(builtinSchemas))
+	for i, schema := range builtinSchemas {
+		names[i] = schema.Name
+	}
+	return names
+}
+
+// DetectSchema returns the first built-in schema profile, which has every
+// column opts require in header h: timestamp, counters (unless it's lenient
+// mode) and group-by columns, see [Options.requiredColumns]. If there is no
+// such profile, it reports missing columns of the closest one.
+func DetectSchema(h CSVHeader, opts *Options) (*Schema, error) {
+	var closest *Schema
+	var closestMissing []string
+	for _, schema := range builtinSchemas {
+		withSchema := *opts
+		withSchema.Schema = schema
+
+		var missing []string
+		for _, col := range withSchema.requiredColumns() {
+			if _, present := h[col]; !present {
+				missing = append(missing, col)
+			}
+		}
+		if len(missing) == 0 {
+			return schema, nil
+		} else if closest == nil || len(missing) < len(closestMissing) {
+			closest, closestMissing = schema, missing
+		}
+	}
+
+	return nil, fmt.Errorf("can't detect schema of input, the closest is %q: %w",
+		closest.Name, &HeaderError{Missing: closestMissing})
+}
+
+// validate checks every logical field is mapped
+func (self *Schema) validate() error {
+	if self.TimeLayout == "" {
+		return fmt.Errorf("schema %q: empty time_layout", self.Name)
+	} else if _, present := durationUnits[self.DurationUnit]; !present {
+		return fmt.Errorf(
+			"schema %q: unknown duration_unit %q, expected s, ms or us",
+			self.Name, self.DurationUnit)
+	}
+	for _, field := range logicalFields {
+		if self.Fields[field] == "" {
+			return fmt.Errorf("schema %q: field %q isn't mapped", self.Name, field)
+		}
+	}
+	return nil
+}
+
+// requiredFields returns logical fields, which must exist in input. In lenient
+// mode input can miss counters.
+func (self *Schema) requiredFields(lenient bool) []string {
+	fields := make([]string, 0, len(logicalFields))
+	for _, field := range logicalFields {
+		if !lenient || !counterFields[field] {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Column returns name of input column for name. name can be a logical field,
+// like "dst_ip", or a column of our output, like "Destination.IP", or any
+// other input column, which is returned as is.
+func (self *Schema) Column(name string) string {
+	if field, present := outFields[name]; present {
+		return self.Fields[field]
+	} else if col, present := self.Fields[name]; present {
+		return col
+	}
+	return name
+}
+
+// ParseTime parses timestamp s according to time layout of the schema
+func (self *Schema) ParseTime(s string) (time.Time, error) {
+	if self.TimeLayout != UnixTimeLayout {
+		return time.Parse(self.TimeLayout, s)
+	}
+
+	sec, frac, _ := strings.Cut(s, ".")
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing time %q: %w", s, err)
+	}
+	var nsecs int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		frac += strings.Repeat("0", 9-len(frac))
+		if nsecs, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, fmt.Errorf("parsing time %q: %w", s, err)
+		}
+	}
+
+	return time.Unix(secs, nsecs).UTC(), nil
+}
+
+// ParseDuration parses duration s according to duration unit of the schema and
+// returns it in microseconds. Empty duration or "-", like Zeek writes for
+// unknown one, means 0.
+func (self *Schema) ParseDuration(s string) (uint64, error) {
+	if s == "" || s == "-" {
+		return 0, nil
+	}
+
+	d, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	us := math.Round(d * durationUnits[self.DurationUnit])
+	if !(us >= 0 && us < math.MaxUint64) {
+		return 0, fmt.Errorf("duration %q is out of range", s)
+	}
+	return uint64(us), nil
+}
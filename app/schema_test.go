@@ -0,0 +1,172 @@
+package app
+
+import (
+	"encoding/csv"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testNfdump = `ts,te,td,sa,da,sp,dp,pr,flg,ipkt,ibyt,opkt,obyt
+2017-04-26 11:11:17.123,2017-04-26 11:11:18,1.0,10.0.0.1,172.19.1.46,5000,3128,TCP,.AP.SF,22,132,55,110414`
+
+	testZeek = `ts,uid,id.orig_h,id.orig_p,id.resp_h,id.resp_p,proto,orig_pkts,orig_ip_bytes,resp_pkts,resp_ip_bytes
+1493205077.500000,C1,10.0.0.1,5000,172.19.1.46,3128,tcp,22,132,55,110414`
+)
+
+func TestLoadSchema(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, name := range SchemaNames() {
+		schema, err := LoadSchema(name)
+		require.NoError(err)
+		assert.Equal(name, schema.Name)
+		assert.NoError(schema.validate())
+	}
+
+	schema, err := LoadSchema(AutoSchema)
+	require.NoError(err)
+	assert.Nil(schema)
+
+	_, err = LoadSchema("unknown")
+	assert.Error(err)
+
+	dir := t.TempDir()
+	yamlFile := path.Join(dir, "my.yaml")
+	require.NoError(os.WriteFile(yamlFile, []byte(`
+time_layout: "2006-01-02 15:04:05"
+fields:
+  timestamp: start
+  dst_ip: dst
+  proto: protocol
+  fwd_packets: out_pkts
+  bwd_packets: in_pkts
+  fwd_bytes: out_bytes
+  bwd_bytes: in_bytes
+`), 0666))
+	schema, err = LoadSchema(yamlFile)
+	require.NoError(err)
+	assert.Equal(yamlFile, schema.Name)
+	assert.Equal("dst", schema.Column("Destination.IP"))
+	assert.Equal("dst", schema.Column(FieldDstIP))
+	assert.Equal("Source.IP", schema.Column("Source.IP"))
+
+	jsonFile := path.Join(dir, "my.json")
+	require.NoError(os.WriteFile(jsonFile, []byte(`{
+  "name": "my",
+  "time_layout": "unix",
+  "fields": {"timestamp": "ts", "dst_ip": "dst", "proto": "p"}
+}`), 0666))
+	_, err = LoadSchema(jsonFile)
+	assert.ErrorContains(err, "fwd_packets")
+}
+
+func TestDetectSchema(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tests := map[string]string{
+		testRecord2: "cicflowmeter",
+		testNfdump:  "nfdump",
+		testZeek:    "zeek",
+	}
+	for input, want := range tests {
+		h, err := NewHeader(csv.NewReader(strings.NewReader(input)))
+		require.NoError(err)
+		schema, err := DetectSchema(h, NewOptions())
+		require.NoError(err)
+		assert.Equal(want, schema.Name)
+	}
+
+	h, err := NewHeader(csv.NewReader(strings.NewReader(testRecord1)))
+	require.NoError(err)
+	_, err = DetectSchema(h, NewOptions())
+	var herr *HeaderError
+	require.ErrorAs(err, &herr)
+	assert.Len(herr.Missing, len(logicalFields))
+
+	// Dest IP and proto are required only if we group by them
+	h, err = NewHeader(csv.NewReader(strings.NewReader(
+		"sa,ts,ipkt,opkt,ibyt,obyt\n10.0.0.1,2017-04-26 11:11:17,22,55,132,110414")))
+	require.NoError(err)
+	_, err = DetectSchema(h, NewOptions())
+	assert.Error(err)
+	opts := NewOptions()
+	require.NoError(opts.GroupBy.Set("sa"))
+	schema, err := DetectSchema(h, opts)
+	require.NoError(err)
+	assert.Equal("nfdump", schema.Name)
+}
+
+func TestParseTimeUnix(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := &Schema{TimeLayout: UnixTimeLayout}
+	tests := map[string]time.Time{
+		"1493205077":            time.Date(2017, 4, 26, 11, 11, 17, 0, time.UTC),
+		"1493205077.5":          time.Date(2017, 4, 26, 11, 11, 17, 5e8, time.UTC),
+		"1493205077.1234567891": time.Date(2017, 4, 26, 11, 11, 17, 123456789, time.UTC),
+	}
+	for s, want := range tests {
+		got, err := schema.ParseTime(s)
+		assert.NoError(err, s)
+		assert.Equal(want, got, s)
+	}
+
+	for _, s := range []string{"", "x", "1.x"} {
+		_, err := schema.ParseTime(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestNewRecordSchema(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, input := range []string{testNfdump, testZeek} {
+		r := csv.NewReader(strings.NewReader(input))
+		h, opts, err := NewInputHeader(r, NewOptions())
+		require.NoError(err)
+
+		rec, err := NewRecord(h, r, opts)
+		require.NoError(err)
+		assert.Equal("2017-04-26-11", rec.TimeID)
+		assert.Equal("172.19.1.46", rec.Keys[0])
+		assert.Equal(uint64(77), rec.Packets)
+		assert.Equal(uint64(110546), rec.Bytes)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]uint64{
+		"":      0,
+		"-":     0,
+		"1":     1000000,
+		"1.5":   1500000,
+		"0.001": 1000,
+	}
+	schema := &Schema{DurationUnit: "s"}
+	for s, want := range tests {
+		got, err := schema.ParseDuration(s)
+		assert.NoError(err, s)
+		assert.Equal(want, got, s)
+	}
+
+	got, err := (&Schema{DurationUnit: "us"}).ParseDuration("1234")
+	assert.NoError(err)
+	assert.Equal(uint64(1234), got)
+
+	for _, s := range []string{"x", "-1", "1e30", "NaN"} {
+		_, err := schema.ParseDuration(s)
+		assert.Error(err, s)
+	}
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Sink stores aggregated data. During one run it can get data of the same
+// bucket many times and must keep all of them.
+type Sink interface {
+	// WriteHour stores data of bucket timeID. It can be called concurrently for
+	// different buckets.
+	WriteHour(timeID string, data HourData) error
+	// Close finishes writing of data
+	Close() error
+}
+
+// hourStreamer is a [Sink], which can store rows of bucket one by one, so data
+// of bucket doesn't have to fit into memory.
+type hourStreamer interface {
+	// OpenHour starts storing of bucket timeID. It returns writer of rows and
+	// source of rows stored before, which the writer replaces, so they must be
+	// added to new rows. prev is nil if there are no such rows.
+	OpenHour(timeID string) (w hourWriter, prev rowSource, err error)
+}
+
+// hourWriter stores rows of one bucket
+type hourWriter interface {
+	// Write writes one aggregated row
+	Write(netflow *CSVRecord) error
+	// Commit stores every written row at once
+	Commit() error
+	// Close discards written rows, if they aren't committed
+	Close() error
+}
+
+// sqliteSinkPrefix is a prefix of --sink value for [SQLiteSink]
+const sqliteSinkPrefix = "sqlite:"
+
+// OpenSink returns [Sink] according to spec. Empty spec means [*OutDir] with
+// outPath dir, which stages its data in tmpDir. "sqlite:flows.db" means
+// [*SQLiteSink] with flows.db database.
+func OpenSink(
+	spec string, outPath string, tmpDir string, opts *Options,
+) (Sink, error) {
+	switch {
+	case spec == "" || spec == "dir":
+		return NewOutDir(outPath, tmpDir, opts), nil
+	case strings.HasPrefix(spec, sqliteSinkPrefix):
+		return NewSQLiteSink(strings.TrimPrefix(spec, sqliteSinkPrefix), opts)
+	}
+	return nil, fmt.Errorf("unknown sink %q, expected dir or sqlite:file.db", spec)
+}
+
+// NewOutDir returns initialized [*OutDir], which saves data into outPath dir
+// according to opts. It merges data with existing files in private staging dir,
+// created in tmpDir like [NewSpiller] does.
+func NewOutDir(outPath string, tmpDir string, opts *Options) *OutDir {
+	return &OutDir{
+		path: outPath,
+		opts: opts,
+		out:  newBucketWriter(tmpDir, opts),
+		seen: make(map[string]bool),
+	}
+}
+
+// OutDir saves aggregated data of every bucket into its own file, named like
+// day-hour.csv, and keeps a map of previously saved day-hours.
+type OutDir struct {
+	path string          // output dir
+	opts *Options        // settings of output
+	out  bucketWriter    // writer of buckets by WriteHour
+	seen map[string]bool // map of known day-hours
+	mu   sync.Mutex      // protects seen
+}
+
+// WriteHour saves data into outPath/timeID.csv file. If we already saved data
+// into this file, it adds data to data of the file. If such file exist and we
+// haven't yet saved any data into it, WriteHour overwrites this file, because
+// it means, this file left here from prev exec. With opts.Merge it adds data of
+// such file to new data instead, so output files accumulate data of every run.
+//
+// It writes data by [OutDir.OpenHour] like every other bucket, so rows of the
+// file are merged within memory data takes, spilling the rest into private
+// staging dir.
+func (self *OutDir) WriteHour(timeID string, data HourData) error {
+	var limit int64
+	for _, netflow := range data {
+		limit += recordSize(netflow)
+	}
+
+	rows := recordRows(SortOrder(SortKey).Sorted(data))
+	return self.out.writeBucket(self, timeID, rows, limit)
+}
+
+// OpenHour starts saving of bucket timeID into outPath/timeID.csv file like
+// [OutDir.WriteHour] does, but row by row. Rows go into temporary file, which
+// replaces the output file on commit. If WriteHour would add data to data of
+// existing file, OpenHour returns rows of that file as prev.
+func (self *OutDir) OpenHour(timeID string) (hourWriter, rowSource, error) {
+	fname := self.fname(timeID)
+	self.mu.Lock()
+	seen := self.seen[timeID]
+	self.mu.Unlock()
+
+	var prev rowSource
+	if seen || self.opts.Merge {
+		if _, err := os.Stat(fname); err == nil {
+			prev = fileRows(fname, self.opts)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+
+	f, err := createHourFile(fname, self.opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	f.commit = func() {
+		self.mu.Lock()
+		self.seen[timeID] = true
+		self.mu.Unlock()
+	}
+
+	return f, prev, nil
+}
+
+// fname returns name of output file of bucket timeID
+func (self *OutDir) fname(timeID string) string {
+	return path.Join(self.path, timeID+self.opts.OutExt())
+}
+
+// Close removes staging dir, if it was created. Every output file is closed
+// after writing already.
+func (self *OutDir) Close() error {
+	return self.out.stage.Remove()
+}
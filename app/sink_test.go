@@ -0,0 +1,226 @@
+package app
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenSink(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	outPath := t.TempDir()
+	for _, spec := range []string{"", "dir"} {
+		sink, err := OpenSink(spec, outPath, t.TempDir(), NewOptions())
+		require.NoError(err)
+		assert.IsType(&OutDir{}, sink)
+	}
+
+	sink, err := OpenSink("sqlite:"+path.Join(outPath, "flows.db"), outPath,
+		t.TempDir(), NewOptions())
+	require.NoError(err)
+	assert.IsType(&SQLiteSink{}, sink)
+	require.NoError(sink.Close())
+
+	_, err = OpenSink("foo:bar", outPath, t.TempDir(), NewOptions())
+	assert.Error(err)
+}
+
+func TestSQLiteSink(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	netflow, err := makeTestRecordCompact()
+	require.NoError(err)
+	data := HourData{netflow.ID: netflow}
+
+	fname := path.Join(t.TempDir(), "flows.db")
+	// Every run opens the database again and upserts the same data
+	for i := 0; i < 2; i++ {
+		sink, err := NewSQLiteSink(fname, NewOptions())
+		require.NoError(err)
+		require.NoError(sink.WriteHour(netflow.TimeID, data))
+		require.NoError(sink.Close())
+	}
+
+	db, err := sql.Open("sqlite", fname)
+	require.NoError(err)
+	defer db.Close()
+
+	var bucket, dstIP, proto string
+	var packets, bytes uint64
+	rows, err := db.Query("SELECT bucket, dst_ip, proto, packets, bytes FROM flows")
+	require.NoError(err)
+	defer rows.Close()
+
+	require.True(rows.Next())
+	require.NoError(rows.Scan(&bucket, &dstIP, &proto, &packets, &bytes))
+	assert.Equal(netflow.TimeID, bucket)
+	assert.Equal(netflow.Keys, []string{dstIP, proto})
+	assert.Equal(2*netflow.Packets, packets)
+	assert.Equal(2*netflow.Bytes, bytes)
+	assert.False(rows.Next())
+	require.NoError(rows.Err())
+}
+
+func TestSQLiteSinkColumns(t *testing.T) {
+	require := require.New(t)
+
+	fname := path.Join(t.TempDir(), "flows.db")
+	sink, err := NewSQLiteSink(fname, NewOptions())
+	require.NoError(err)
+	require.NoError(sink.Close())
+
+	opts := NewOptions()
+	require.NoError(opts.GroupBy.Set("Source.IP"))
+	assert.Equal(t, []string{"bucket", "source_ip", "packets", "bytes"},
+		sqliteColumns(opts))
+
+	// Existing table has another group-by columns
+	_, err = NewSQLiteSink(fname, opts)
+	require.Error(err)
+
+	// Every output column needs its own table column
+	for _, groupBy := range []string{
+		"bucket", "Source.IP,Source IP", "dst_ip,Destination.IP", "packets",
+		"flows",
+	} {
+		opts := NewOptions()
+		opts.Metrics = true
+		require.NoError(opts.GroupBy.Set(groupBy))
+		_, err := NewSQLiteSink(path.Join(t.TempDir(), "flows.db"), opts)
+		assert.ErrorContains(t, err, "are both column", groupBy)
+	}
+}
+
+func TestSQLiteSinkMetrics(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Approx = 1
+	assert.Equal([]string{"bucket", "dst_ip", "proto", "packets", "bytes",
+		"packets_error", "bytes_error"}, sqliteColumns(opts))
+
+	sink, err := NewSQLiteSink(path.Join(t.TempDir(), "flows.db"), opts)
+	require.NoError(err)
+	defer sink.Close()
+
+	rec := makeApproxRecords(opts)[0]
+	rec.Metrics[0], rec.Metrics[1] = 7, 11
+	for i := 0; i < 2; i++ {
+		require.NoError(sink.WriteHour(rec.TimeID, HourData{rec.ID: rec}))
+	}
+
+	var packetsErr, bytesErr int64
+	require.NoError(sink.db.QueryRow(
+		"SELECT packets_error, bytes_error FROM flows").Scan(
+		&packetsErr, &bytesErr))
+	assert.Equal(int64(14), packetsErr)
+	assert.Equal(int64(22), bytesErr)
+}
+
+func TestOutDirMerge(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	netflow, err := makeTestRecordCompact()
+	require.NoError(err)
+
+	for _, format := range []string{FormatCSV, FormatParquet} {
+		opts := NewOptions()
+		require.NoError(opts.Format.Set(format))
+		opts.Merge = true
+
+		// Every run creates new sink, like new exec
+		outPath := t.TempDir()
+		for i := 0; i < 2; i++ {
+			sink := NewOutDir(outPath, t.TempDir(), opts)
+			data := HourData{netflow.ID: &CSVRecord{
+				TimeID:  netflow.TimeID,
+				ID:      netflow.ID,
+				Keys:    netflow.Keys,
+				Packets: netflow.Packets,
+				Bytes:   netflow.Bytes,
+			}}
+			require.NoError(sink.WriteHour(netflow.TimeID, data))
+		}
+
+		fname := path.Join(outPath, netflow.TimeID+opts.OutExt())
+		assertDirFiles(t, outPath, path.Base(fname))
+		data, err := loadHourFile(fname, opts)
+		require.NoError(err)
+		require.Len(data, 1)
+		require.Contains(data, netflow.ID)
+		assert.Equal(2*netflow.Packets, data[netflow.ID].Packets)
+		assert.Equal(2*netflow.Bytes, data[netflow.ID].Bytes)
+	}
+}
+
+func TestOutDirWriteHourSpill(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Rows of the file don't fit into memory of one new row, so merging spills
+	// them into staging dir in tmpDir, which is removed on close.
+	tmpDir := t.TempDir()
+	opts := NewOptions()
+	outPath := t.TempDir()
+	sink := NewOutDir(outPath, tmpDir, opts)
+	data := make(HourData)
+	var total CSVRecord
+	for _, rec := range makeSpillRecords(1000) {
+		if rec.TimeID == "2017-04-26-10" {
+			require.NoError(total.Add(rec))
+			require.NoError(data.Add(rec))
+		}
+	}
+	require.NoError(sink.WriteHour("2017-04-26-10", data))
+
+	rec := makeSpillRecords(1)[0]
+	rec.TimeID, rec.Packets, rec.Bytes = "2017-04-26-10", 1, 2
+	rec.ID = rec.genUniqID()
+	require.NoError(sink.WriteHour(rec.TimeID, HourData{rec.ID: rec}))
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(err)
+	require.Len(entries, 1)
+	assert.True(strings.HasPrefix(entries[0].Name(), "fc-staging-"))
+	require.NoError(sink.Close())
+	assertDirFiles(t, tmpDir)
+
+	merged, err := loadHourFile(path.Join(outPath, "2017-04-26-10.csv"), opts)
+	require.NoError(err)
+	assert.Len(merged, 50)
+	var sum CSVRecord
+	for _, netflow := range merged {
+		require.NoError(sum.Add(netflow))
+	}
+	assert.Equal(total.Packets+1, sum.Packets)
+	assert.Equal(total.Bytes+2, sum.Bytes)
+}
+
+func TestOutDirParallel(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	outPath := t.TempDir()
+	spiller := NewSpiller(t.TempDir(), 256<<20, 4, opts)
+	defer spiller.Close()
+	for _, rec := range makeSpillRecords(1000) {
+		require.NoError(spiller.Add(rec))
+	}
+	require.NoError(spiller.Commit(NewOutDir(outPath, t.TempDir(), opts)))
+
+	for _, timeID := range []string{"2017-04-26-10", "2017-04-26-11", "2017-04-26-12"} {
+		netflows, err := loadRecordsCompact(path.Join(outPath, timeID+".csv"))
+		require.NoError(err)
+		assert.Len(netflows, 50)
+	}
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Units of [ByteSize]. They are binary, so "1MB" means 1048576 bytes.
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ByteSize is a num of bytes, which can be defined like "256MB", "1G" or
+// "65536". It implements [flag.Value].
+type ByteSize int64
+
+// ParseByteSize parses s and returns it as [ByteSize]. It understands
+// suffixes B, K, KB, M, MB, G and GB in any case. The size must be positive.
+func ParseByteSize(s string) (ByteSize, error) {
+	num, unit := strings.ToUpper(strings.TrimSpace(s)), ByteSize(1)
+	for _, u := range byteSizeUnits {
+		if n, found := strings.CutSuffix(num, u.suffix); found {
+			num, unit = strings.TrimSpace(n), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	} else if n <= 0 || ByteSize(n) > (1<<63-1)/unit {
+		return 0, fmt.Errorf("invalid size %q: out of range", s)
+	}
+
+	return ByteSize(n) * unit, nil
+}
+
+// String returns the size with the largest unit, which divides it, like
+// "64KB". It implements [flag.Value].
+func (self ByteSize) String() string {
+	for _, u := range byteSizeUnits {
+		if self != 0 && u.size > 1 && self%u.size == 0 && len(u.suffix) == 2 {
+			return strconv.FormatInt(int64(self/u.size), 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(self), 10)
+}
+
+// Set parses s like [ParseByteSize] does and assigns the result. It implements
+// [flag.Value].
+func (self *ByteSize) Set(s string) error {
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*self = size
+	return nil
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseByteSize(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tests := []struct {
+		s    string
+		size ByteSize
+		str  string
+	}{
+		{"65536", 65536, "64KB"},
+		{"100", 100, "100"},
+		{"100b", 100, "100"},
+		{"64K", 64 << 10, "64KB"},
+		{"256MB", 256 << 20, "256MB"},
+		{"256 mb", 256 << 20, "256MB"},
+		{"1G", 1 << 30, "1GB"},
+		{"1536M", 1536 << 20, "1536MB"},
+	}
+
+	for _, tt := range tests {
+		size, err := ParseByteSize(tt.s)
+		require.NoError(err, tt.s)
+		assert.Equal(tt.size, size, tt.s)
+		assert.Equal(tt.str, size.String(), tt.s)
+	}
+
+	for _, s := range []string{"", "0", "-1", "1T", "MB", "1.5G", "9999999999G"} {
+		_, err := ParseByteSize(s)
+		assert.Error(err, s)
+	}
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Orders of rows in output files
+const (
+	SortKey     = "key"     // by group-by key ascending
+	SortBytes   = "bytes"   // by bytes descending
+	SortPackets = "packets" // by packets descending
+)
+
+// SortOrder defines order of rows in output files. Rows with equal bytes or
+// packets are sorted by key, so the order is always the same for the same
+// data. Zero value means [SortKey].
+type SortOrder string
+
+// String returns name of the order. It implements [flag.Value].
+func (self *SortOrder) String() string {
+	if *self == "" {
+		return SortKey
+	}
+	return string(*self)
+}
+
+// Set checks s is a known order and assigns it. It implements [flag.Value].
+func (self *SortOrder) Set(s string) error {
+	switch s {
+	case SortKey, SortBytes, SortPackets:
+		*self = SortOrder(s)
+		return nil
+	}
+	return fmt.Errorf("unknown sort order %q, expected %s, %s or %s",
+		s, SortKey, SortBytes, SortPackets)
+}
+
+// less returns true if row a goes before row b in this order
+func (self SortOrder) less(a, b *CSVRecord) bool {
+	switch {
+	case self == SortBytes && a.Bytes != b.Bytes:
+		return a.Bytes > b.Bytes
+	case self == SortPackets && a.Packets != b.Packets:
+		return a.Packets > b.Packets
+	}
+	// Uniq ID is time ID and keys, separated by the lowest byte, so it sorts
+	// like keys do.
+	return a.ID < b.ID
+}
+
+// Sorted returns records of data sorted in this order
+func (self SortOrder) Sorted(data HourData) []*CSVRecord {
+	records := make([]*CSVRecord, 0, len(data))
+	for _, netflow := range data {
+		records = append(records, netflow)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return self.less(records[i], records[j])
+	})
+	return records
+}
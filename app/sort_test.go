@@ -0,0 +1,46 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortOrder(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var order SortOrder
+	assert.Equal(SortKey, order.String())
+	assert.Error(order.Set("ip"))
+
+	data := make(HourData)
+	for _, rec := range []*CSVRecord{
+		{TimeID: "2017-04-26-11", Keys: []string{"10.0.0.2", "TCP"}, Packets: 1, Bytes: 30},
+		{TimeID: "2017-04-26-11", Keys: []string{"10.0.0.1", "UDP"}, Packets: 3, Bytes: 10},
+		{TimeID: "2017-04-26-11", Keys: []string{"10.0.0.1", "TCP"}, Packets: 2, Bytes: 10},
+		{TimeID: "2017-04-26-11", Keys: []string{"10.0.0.10", "TCP"}, Packets: 2, Bytes: 20},
+	} {
+		rec.ID = rec.genUniqID()
+		require.NoError(data.Add(rec))
+	}
+
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{SortKey, []string{"10.0.0.1,TCP", "10.0.0.1,UDP", "10.0.0.10,TCP", "10.0.0.2,TCP"}},
+		{SortBytes, []string{"10.0.0.2,TCP", "10.0.0.10,TCP", "10.0.0.1,TCP", "10.0.0.1,UDP"}},
+		{SortPackets, []string{"10.0.0.1,UDP", "10.0.0.1,TCP", "10.0.0.10,TCP", "10.0.0.2,TCP"}},
+	}
+
+	for _, tt := range tests {
+		require.NoError(order.Set(tt.order))
+		var got []string
+		for _, rec := range order.Sorted(data) {
+			got = append(got, rec.Keys[0]+","+rec.Keys[1])
+		}
+		assert.Equal(tt.want, got, tt.order)
+	}
+}
@@ -0,0 +1,460 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// recordOverhead is estimated num of bytes of memory one aggregated record
+// takes in addition to its strings: the struct, pointers and map entry.
+const recordOverhead = 160
+
+// NewSpiller returns initialized [*Spiller]. It spills data, when estimated
+// size of aggregated data reaches memLimit, into private staging dir, created
+// in tmpDir (default dir for temporary files if it's empty) on the first
+// spill. On commit it writes up to writers buckets in parallel, 0 means
+// GOMAXPROCS. opts are settings of aggregation.
+func NewSpiller(
+	tmpDir string, memLimit ByteSize, writers int, opts *Options,
+) *Spiller {
+	if writers == 0 {
+		writers = runtime.GOMAXPROCS(0)
+	}
+
+	return &Spiller{
+		bucketWriter: newBucketWriter(tmpDir, opts),
+		limit:        int64(memLimit),
+		writers:      writers,
+		data:         make(HourData),
+	}
+}
+
+// Spiller aggregates records in memory like [HourData] does, but when
+// estimated size of aggregated data reaches memory limit, it spills them into
+// run file in staging dir, sorted by uniq ID. On commit it merges every run, so
+// it never keeps in memory more than memory limit of aggregated data,
+// regardless of order of input and num of keys per bucket. While data fit into
+// memory limit, it works as fast as pure in-memory aggregation and doesn't
+// touch disk at all.
+type Spiller struct {
+	bucketWriter          // staging dir for run files and their settings
+	limit        int64    // memory limit in bytes
+	writers      int      // num of goroutines writing buckets
+	data         HourData // aggregated data, which isn't spilled yet
+	size         int64    // estimated size of data in bytes
+	runs         []string // names of run files
+}
+
+// Add inserts new netflow into aggregated data or adds its bytes and packets
+// to existing data. It spills aggregated data, when memory limit reached.
+func (self *Spiller) Add(netflow *CSVRecord) error {
+	if nf, present := self.data[netflow.ID]; present {
+		return self.opts.Overflow.check(nf.Add(netflow))
+	}
+
+	// Keys can share memory with the whole input line, don't keep it.
+	for i, key := range netflow.Keys {
+		netflow.Keys[i] = strings.Clone(key)
+	}
+	self.data[netflow.ID] = netflow
+	self.size += recordSize(netflow)
+
+	if self.size >= self.limit {
+		return self.spill()
+	}
+	return nil
+}
+
+// recordSize returns estimated num of bytes of memory netflow takes
+func recordSize(netflow *CSVRecord) int64 {
+	size := int64(recordOverhead + len(netflow.ID) + len(netflow.TimeID))
+	for _, key := range netflow.Keys {
+		size += int64(16 + len(key))
+	}
+	// Slice of metrics and their values
+	size += int64(24 + 8*len(netflow.Metrics))
+	return size
+}
+
+// Spilled returns true if it spilled any data on disk
+func (self *Spiller) Spilled() bool {
+	return len(self.runs) > 0
+}
+
+// spill writes aggregated data into new run file, sorted by uniq ID, and
+// resets aggregated data.
+func (self *Spiller) spill() error {
+	// Uniq ID is the order of merge
+	records := SortOrder(SortKey).Sorted(self.data)
+	fname, err := self.stage.writeRun(func(w RecordWriter) error {
+		for _, netflow := range records {
+			if err := w.Write(netflow); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	self.runs = append(self.runs, fname)
+	self.data = make(HourData)
+	self.size = 0
+
+	return nil
+}
+
+// Commit writes every aggregated data into sink. If nothing was spilled, it
+// writes buckets from memory. Otherwise it spills the rest of data and merges
+// all runs, staging every bucket in memory or in staged file, so it keeps
+// memory limit, and writes every bucket, once merged. Either way it writes
+// buckets by pool of goroutines, see [Spiller.writeBucket], and reports errors
+// of every failed bucket at once.
+func (self *Spiller) Commit(sink Sink) error {
+	if !self.Spilled() {
+		return self.commitMemory(sink)
+	}
+
+	if len(self.data) > 0 {
+		if err := self.spill(); err != nil {
+			return err
+		}
+	}
+
+	// Reduce num of runs, so we can merge them at once.
+	runs, err := self.stage.reduceRuns(self.runs, SortKey)
+	self.runs = runs
+	if err != nil {
+		return err
+	}
+
+	// Every bucket, which writers write, needs memory for its rows and to sort
+	// them on write, and the merge collects one more bucket meanwhile.
+	limit := self.limit / int64(2*self.writers+1)
+	pool := newBucketPool(self.writers)
+	var bucket *stagedBucket
+	write := func() {
+		bucket := bucket
+		pool.Write(bucket.timeID, func() error {
+			defer bucket.remove()
+			if err := bucket.finish(); err != nil {
+				return err
+			}
+			return self.writeBucket(sink, bucket.timeID, bucket.rows(), limit)
+		})
+	}
+
+	err = mergeRuns(self.runs, self.opts, SortKey, func(netflow *CSVRecord) error {
+		if bucket != nil && netflow.TimeID != bucket.timeID {
+			write()
+			bucket = nil
+		}
+		if bucket == nil {
+			bucket = newStagedBucket(self.stage, netflow.TimeID, limit)
+		}
+		return bucket.Add(netflow)
+	})
+	if err == nil && bucket != nil {
+		write()
+	}
+
+	return errors.Join(err, pool.Wait())
+}
+
+// commitMemory writes aggregated data from memory into sink. It writes buckets
+// by pool of goroutines and reports errors of every failed bucket at once.
+func (self *Spiller) commitMemory(sink Sink) error {
+	buckets := make(map[string]HourData)
+	for id, netflow := range self.data {
+		if _, present := buckets[netflow.TimeID]; !present {
+			buckets[netflow.TimeID] = make(HourData)
+		}
+		buckets[netflow.TimeID][id] = netflow
+	}
+
+	timeIDs := make([]string, 0, len(buckets))
+	for timeID := range buckets {
+		timeIDs = append(timeIDs, timeID)
+	}
+	sort.Strings(timeIDs)
+
+	// Data is in memory already, every writer can sort by its share of memory
+	// limit.
+	limit := self.limit / int64(self.writers)
+	return writeBuckets(timeIDs, self.writers, func(timeID string) error {
+		rows := recordRows(SortOrder(SortKey).Sorted(buckets[timeID]))
+		return self.writeBucket(sink, timeID, rows, limit)
+	})
+}
+
+// writeBuckets calls write for every bucket of timeIDs by pool of writers
+// goroutines. It returns errors of every failed bucket at once, in order of
+// timeIDs.
+func writeBuckets(
+	timeIDs []string, writers int, write func(timeID string) error,
+) error {
+	pool := newBucketPool(writers)
+	for _, timeID := range timeIDs {
+		timeID := timeID
+		pool.Write(timeID, func() error { return write(timeID) })
+	}
+	return pool.Wait()
+}
+
+// newBucketPool returns initialized [*bucketPool] of writers goroutines
+func newBucketPool(writers int) *bucketPool {
+	self := &bucketPool{jobs: make(chan bucketJob)}
+	self.wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer self.wg.Done()
+			for job := range self.jobs {
+				if err := job.write(); err != nil {
+					self.fail(job.i, fmt.Errorf("%s: %w", job.timeID, err))
+				}
+			}
+		}()
+	}
+	return self
+}
+
+// bucketPool writes buckets by pool of goroutines, as they come. It keeps
+// errors of every failed bucket in order of buckets.
+type bucketPool struct {
+	jobs chan bucketJob
+	wg   sync.WaitGroup
+	errs []error    // error of every bucket by its num
+	mu   sync.Mutex // protects errs
+}
+
+// bucketJob is a write of one bucket
+type bucketJob struct {
+	i      int    // num of bucket
+	timeID string // time ID of bucket
+	write  func() error
+}
+
+// Write hands write of bucket timeID to a free goroutine. It blocks while
+// every goroutine is busy.
+func (self *bucketPool) Write(timeID string, write func() error) {
+	self.mu.Lock()
+	i := len(self.errs)
+	self.errs = append(self.errs, nil)
+	self.mu.Unlock()
+
+	self.jobs <- bucketJob{i: i, timeID: timeID, write: write}
+}
+
+// fail keeps error of bucket i
+func (self *bucketPool) fail(i int, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.errs[i] = err
+}
+
+// Wait waits for every bucket and returns errors of every failed bucket at
+// once, in order of buckets.
+func (self *bucketPool) Wait() error {
+	close(self.jobs)
+	self.wg.Wait()
+	return errors.Join(self.errs...)
+}
+
+// newBucketWriter returns initialized [bucketWriter] with private staging dir,
+// created in tmpDir on demand. opts are settings of output.
+func newBucketWriter(tmpDir string, opts *Options) bucketWriter {
+	opts = opts.Staging()
+	return bucketWriter{
+		stage: &stagingDir{parent: tmpDir, opts: opts},
+		opts:  opts,
+	}
+}
+
+// bucketWriter writes aggregated buckets into sink, applying top N and order
+// of rows of opts within memory limit.
+type bucketWriter struct {
+	stage *stagingDir // private staging dir for temporary files
+	opts  *Options    // settings of temporary files and output rows
+}
+
+// writeBucket writes rows of bucket timeID, sorted by key, into sink. If sink
+// can store bucket row by row, it writes the whole bucket at once, adding rows
+// sink had before, otherwise it writes bucket by chunks up to limit. Every
+// step sorts within limit of memory, spilling the rest into staging dir.
+func (self *bucketWriter) writeBucket(
+	sink Sink, timeID string, rows rowSource, limit int64,
+) error {
+	streamer, ok := sink.(hourStreamer)
+	if !ok {
+		return self.writeChunks(sink, timeID, rows, limit)
+	}
+
+	w, prev, err := streamer.OpenHour(timeID)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if prev != nil {
+		rows = self.mergeRows(rows, prev, limit)
+	}
+	if err := self.ordered(rows, limit, w.Write); err != nil {
+		return err
+	}
+
+	return w.Commit()
+}
+
+// writeChunks writes rows of bucket timeID into sink by chunks up to limit
+func (self *bucketWriter) writeChunks(
+	sink Sink, timeID string, rows rowSource, limit int64,
+) error {
+	var size int64
+	chunk := make(HourData)
+	err := self.ordered(rows, limit, func(netflow *CSVRecord) error {
+		chunk[netflow.ID] = netflow
+		size += recordSize(netflow)
+		if size < limit {
+			return nil
+		}
+		err := sink.WriteHour(timeID, chunk)
+		chunk, size = make(HourData), 0
+		return err
+	})
+	if err != nil || len(chunk) == 0 {
+		return err
+	}
+
+	return sink.WriteHour(timeID, chunk)
+}
+
+// mergeRows returns source of aggregated rows of a and b, sorted by key
+func (self *bucketWriter) mergeRows(a, b rowSource, limit int64) rowSource {
+	return func(emit func(netflow *CSVRecord) error) error {
+		sorter := newRunSorter(self.stage, SortKey, limit)
+		defer sorter.remove()
+		if err := a(sorter.Add); err != nil {
+			return err
+		}
+		if err := b(sorter.Add); err != nil {
+			return err
+		}
+		return sorter.Sorted(emit)
+	}
+}
+
+// ordered passes rows, sorted by key, to emit in order of output. If opts want
+// top N rows, it passes top rows only.
+func (self *bucketWriter) ordered(
+	rows rowSource, limit int64, emit func(netflow *CSVRecord) error,
+) error {
+	switch {
+	case self.opts.Top > 0:
+		top := newTopN(self.opts)
+		if err := rows(top.Add); err != nil {
+			return err
+		}
+		return recordRows(self.opts.Sort.Sorted(top.data()))(emit)
+	case self.opts.Sort == "" || self.opts.Sort == SortKey:
+		return rows(emit)
+	}
+
+	sorter := newRunSorter(self.stage, self.opts.Sort, limit)
+	defer sorter.remove()
+	if err := rows(sorter.Add); err != nil {
+		return err
+	}
+	return sorter.Sorted(emit)
+}
+
+// Close removes staging dir with every run file, if it was created
+func (self *Spiller) Close() error {
+	return self.stage.Remove()
+}
+
+// newStagedBucket returns initialized [*stagedBucket] of bucket timeID, which
+// keeps up to limit of rows in memory and the rest in stage.
+func newStagedBucket(
+	stage *stagingDir, timeID string, limit int64,
+) *stagedBucket {
+	return &stagedBucket{timeID: timeID, stage: stage, limit: limit}
+}
+
+// stagedBucket keeps aggregated rows of one bucket, which come sorted by key.
+// While they fit into memory limit, it keeps them in memory. Otherwise it
+// writes every row into staged file, so bucket can be of any size.
+type stagedBucket struct {
+	timeID  string
+	stage   *stagingDir  // dir for staged file
+	limit   int64        // memory limit in bytes
+	records []*CSVRecord // rows in memory, while there is no staged file
+	size    int64        // estimated size of records in bytes
+	f       *os.File     // staged file, nil while rows fit into memory
+	w       RecordWriter // writer of staged file
+}
+
+// Add adds netflow into the bucket. It moves rows into staged file, when
+// memory limit reached.
+func (self *stagedBucket) Add(netflow *CSVRecord) error {
+	if self.w != nil {
+		return self.w.Write(netflow)
+	}
+
+	self.records = append(self.records, netflow)
+	self.size += recordSize(netflow)
+	if self.size < self.limit {
+		return nil
+	}
+
+	f, err := self.stage.create("bucket")
+	if err != nil {
+		return err
+	}
+	self.f = f
+	self.w = NewRecordWriter(f, self.stage.opts)
+	if err := self.w.WriteHeader(); err != nil {
+		return err
+	}
+	for _, netflow := range self.records {
+		if err := self.w.Write(netflow); err != nil {
+			return err
+		}
+	}
+	self.records, self.size = nil, 0
+
+	return nil
+}
+
+// finish flushes staged file, if any, after the last row
+func (self *stagedBucket) finish() error {
+	if self.f == nil {
+		return nil
+	}
+	if err := self.w.Close(); err != nil {
+		return err
+	}
+	return self.f.Close()
+}
+
+// rows returns source of rows of the bucket, sorted by key
+func (self *stagedBucket) rows() rowSource {
+	if self.f == nil {
+		return recordRows(self.records)
+	}
+	return fileRows(self.f.Name(), self.stage.opts)
+}
+
+// remove removes staged file, if any
+func (self *stagedBucket) remove() error {
+	if self.f == nil {
+		return nil
+	}
+	self.f.Close()
+	return os.Remove(self.f.Name())
+}
@@ -0,0 +1,261 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memSink keeps in memory everything written into it
+type memSink struct {
+	timeIDs []string            // time IDs in order of writes
+	data    map[string]HourData // aggregated data by time ID
+	fail    map[string]bool     // time IDs, which can't be written
+	mu      sync.Mutex
+}
+
+func newMemSink() *memSink {
+	return &memSink{data: make(map[string]HourData)}
+}
+
+func (self *memSink) WriteHour(timeID string, data HourData) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.fail[timeID] {
+		return errors.New("oops")
+	}
+	self.timeIDs = append(self.timeIDs, timeID)
+	if _, present := self.data[timeID]; !present {
+		self.data[timeID] = make(HourData)
+	}
+	for _, netflow := range data {
+		self.data[timeID].Add(netflow)
+	}
+	return nil
+}
+
+func (self *memSink) Close() error {
+	return nil
+}
+
+// makeSpillRecords returns n records of 3 buckets and 50 keys, interleaved
+func makeSpillRecords(n int) []*CSVRecord {
+	timeIDs := []string{"2017-04-26-12", "2017-04-26-10", "2017-04-26-11"}
+	records := make([]*CSVRecord, n)
+	for i := range records {
+		rec := &CSVRecord{
+			TimeID:  timeIDs[i%len(timeIDs)],
+			Keys:    []string{fmt.Sprintf("10.0.0.%d", i%50), "TCP"},
+			Packets: uint64(i),
+			Bytes:   uint64(2 * i),
+		}
+		rec.ID = rec.genUniqID()
+		records[i] = rec
+	}
+	return records
+}
+
+func TestSpiller(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	want := newMemSink()
+	for _, rec := range makeSpillRecords(1000) {
+		require.NoError(want.WriteHour(rec.TimeID, HourData{rec.ID: rec}))
+	}
+
+	// 1 byte spills every new key, so we get more than mergeFanIn runs
+	for _, limit := range []ByteSize{1, 4 << 10, 256 << 20} {
+		tmpDir := t.TempDir()
+		spiller := NewSpiller(tmpDir, limit, 1, NewOptions())
+
+		for _, rec := range makeSpillRecords(1000) {
+			require.NoError(spiller.Add(rec))
+		}
+		assert.Equal(limit < 256<<20, spiller.Spilled(), limit)
+		files, err := os.ReadDir(tmpDir)
+		require.NoError(err)
+		// Staging dir is created on the first spill only
+		assert.Equal(spiller.Spilled(), len(files) == 1, limit)
+
+		got := newMemSink()
+		require.NoError(spiller.Commit(got))
+		require.NoError(spiller.Close())
+
+		require.Equal(len(want.data), len(got.data), limit)
+		for timeID, data := range want.data {
+			require.Contains(got.data, timeID)
+			require.Len(got.data[timeID], len(data))
+			for id, netflow := range data {
+				require.Contains(got.data[timeID], id)
+				assert.Equal(netflow.Packets, got.data[timeID][id].Packets)
+				assert.Equal(netflow.Bytes, got.data[timeID][id].Bytes)
+			}
+		}
+		// Buckets are written in time order
+		assert.IsNonDecreasing(got.timeIDs, limit)
+
+		files, err = os.ReadDir(tmpDir)
+		require.NoError(err)
+		assert.Empty(files, "staging dir removed")
+	}
+}
+
+func TestSpillerParallel(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Spilled buckets go to writers, as they are merged
+	for _, limit := range []ByteSize{256 << 20, 1 << 10} {
+		spiller := NewSpiller(t.TempDir(), limit, 4, NewOptions())
+		defer spiller.Close()
+		for _, rec := range makeSpillRecords(1000) {
+			require.NoError(spiller.Add(rec))
+		}
+
+		sink := newMemSink()
+		sink.fail = map[string]bool{"2017-04-26-10": true, "2017-04-26-12": true}
+		err := spiller.Commit(sink)
+		assert.EqualError(err, "2017-04-26-10: oops\n2017-04-26-12: oops", limit)
+		require.NotEmpty(sink.timeIDs, limit)
+		for _, timeID := range sink.timeIDs {
+			assert.Equal("2017-04-26-11", timeID, limit)
+		}
+		assert.Len(sink.data["2017-04-26-11"], 50, limit)
+
+		spiller = NewSpiller(t.TempDir(), limit, 4, NewOptions())
+		defer spiller.Close()
+		for _, rec := range makeSpillRecords(1000) {
+			require.NoError(spiller.Add(rec))
+		}
+		slow := &slowSink{memSink: newMemSink()}
+		require.NoError(spiller.Commit(slow))
+		assert.Greater(slow.maxBusy, 1, limit)
+	}
+}
+
+// slowSink is a [memSink], which takes a while to write, and counts max num of
+// concurrent writes.
+type slowSink struct {
+	*memSink
+	busy    int
+	maxBusy int
+}
+
+func (self *slowSink) WriteHour(timeID string, data HourData) error {
+	self.mu.Lock()
+	self.busy++
+	self.maxBusy = max(self.maxBusy, self.busy)
+	self.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	self.mu.Lock()
+	self.busy--
+	self.mu.Unlock()
+	return self.memSink.WriteHour(timeID, data)
+}
+
+func TestSpillerSort(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, order := range []string{SortBytes, SortPackets} {
+		opts := NewOptions()
+		require.NoError(opts.Sort.Set(order))
+
+		// The first limit keeps everything in memory, 1 byte spills every row of
+		// every bucket on sort too.
+		var want map[string][]byte
+		for _, limit := range []ByteSize{256 << 20, 1, 1 << 10} {
+			outDir := t.TempDir()
+			spiller := NewSpiller(t.TempDir(), limit, 1, opts)
+			for _, rec := range makeSpillRecords(1000) {
+				require.NoError(spiller.Add(rec))
+			}
+			require.NoError(spiller.Commit(NewOutDir(outDir, t.TempDir(), opts)))
+			require.NoError(spiller.Close())
+
+			files, err := os.ReadDir(outDir)
+			require.NoError(err)
+			got := make(map[string][]byte)
+			for _, file := range files {
+				b, err := os.ReadFile(path.Join(outDir, file.Name()))
+				require.NoError(err)
+				got[file.Name()] = b
+			}
+			if want == nil {
+				want = got
+				continue
+			}
+			assert.Equal(want, got, "%s %d", order, limit)
+		}
+	}
+}
+
+func TestSpillerMerge(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, format := range []string{FormatCSV, FormatParquet} {
+		opts := NewOptions()
+		require.NoError(opts.Format.Set(format))
+		opts.Merge = true
+
+		// The first run saves files, the second one adds its data to them
+		outDir := t.TempDir()
+		for _, limit := range []ByteSize{256 << 20, 1 << 10} {
+			spiller := NewSpiller(t.TempDir(), limit, 1, opts)
+			for _, rec := range makeSpillRecords(1000) {
+				require.NoError(spiller.Add(rec))
+			}
+			require.NoError(spiller.Commit(NewOutDir(outDir, t.TempDir(), opts)))
+			require.NoError(spiller.Close())
+		}
+
+		want := make(HourData)
+		for _, rec := range append(makeSpillRecords(1000), makeSpillRecords(1000)...) {
+			require.NoError(want.Add(rec))
+		}
+
+		files, err := os.ReadDir(outDir)
+		require.NoError(err)
+		assert.Len(files, 3, format)
+		got := make(HourData)
+		for _, file := range files {
+			rows := fileRows(path.Join(outDir, file.Name()), opts)
+			require.NoError(rows(func(rec *CSVRecord) error {
+				// Every key is in one row
+				_, dup := got[rec.ID]
+				require.False(dup, "%s %q", format, rec.ID)
+				got[rec.ID] = rec
+				return nil
+			}))
+		}
+		require.Len(got, len(want), format)
+		for id, rec := range want {
+			require.Contains(got, id)
+			assert.Equal(rec.Packets, got[id].Packets, format)
+			assert.Equal(rec.Bytes, got[id].Bytes, format)
+		}
+	}
+}
+
+func TestRecordSize(t *testing.T) {
+	opts := NewOptions()
+	rec := makeSpillRecords(1)[0]
+	size := recordSize(rec)
+
+	opts.Metrics = true
+	opts.Directional = true
+	rec.setMetrics(opts.metrics())
+	assert.Equal(t, size+8*int64(len(opts.metrics())), recordSize(rec))
+}
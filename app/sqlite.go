@@ -0,0 +1,295 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteTable is a name of table for aggregated data
+const sqliteTable = "flows"
+
+// NewSQLiteSink opens SQLite database fname, creates table for aggregated data,
+// if it doesn't exist, and returns initialized [*SQLiteSink].
+func NewSQLiteSink(fname string, opts *Options) (*SQLiteSink, error) {
+	columns := sqliteColumns(opts)
+	if err := checkSQLiteColumns(outHeaderRecord(opts), columns); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", fname)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has one writer at a time, so concurrent writes of buckets wait for
+	// the connection instead of failing with "database is locked".
+	db.SetMaxOpenConns(1)
+
+	sink := &SQLiteSink{
+		db:       db,
+		columns:  columns,
+		nkeys:    1 + len(opts.GroupBy),
+		metrics:  opts.metrics(),
+		overflow: opts.Overflow,
+	}
+	if err := sink.createTable(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+
+	return sink, nil
+}
+
+// SQLiteSink saves aggregated data into table of SQLite database. The table is
+// keyed by bucket and group-by columns. Saving of data adds packets and bytes to
+// existing rows, so repeated runs over new input accumulate data. Metrics are
+// aggregated the same way, like the smallest value stays the smallest one.
+//
+// SQLite keeps integers as int64, so counters overflow at math.MaxInt64 here.
+type SQLiteSink struct {
+	db       *sql.DB
+	columns  []string // columns of the table in order of output columns
+	nkeys    int      // num of key columns at the start of columns
+	metrics  []metric // metrics after packets and bytes
+	overflow Overflow // what to do, when sum of counters overflows
+}
+
+// sqliteColumns returns names of table columns for our output columns. Known
+// columns are named after logical fields, like dst_ip, the rest ones are
+// converted to snake_case, like source_ip. Metrics have their own names.
+func sqliteColumns(opts *Options) []string {
+	header := outHeaderRecord(opts)
+	metrics := opts.metrics()
+	metricStart := len(header) - len(metrics)
+	columns := make([]string, len(header))
+	for i, col := range header {
+		switch {
+		case i == 0:
+			columns[i] = "bucket"
+		case i >= metricStart:
+			columns[i] = metrics[i-metricStart].column
+		case outFields[col] != "":
+			columns[i] = outFields[col]
+		default:
+			columns[i] = strings.Map(func(r rune) rune {
+				if unicode.IsLetter(r) || unicode.IsDigit(r) {
+					return unicode.ToLower(r)
+				}
+				return '_'
+			}, col)
+		}
+	}
+	return columns
+}
+
+// checkSQLiteColumns checks every output column of header has its own table
+// column of columns. Different names can convert to the same one, like
+// "Source.IP" and "Source IP", or group-by column can be named like another
+// column, like "bucket".
+func checkSQLiteColumns(header, columns []string) error {
+	seen := make(map[string]string, len(columns))
+	for i, col := range columns {
+		if prev, present := seen[col]; present {
+			return fmt.Errorf("columns %q and %q are both column %q of table %s",
+				prev, header[i], col, sqliteTable)
+		}
+		seen[col] = header[i]
+	}
+	return nil
+}
+
+// keyColumns returns columns of primary key: bucket and group-by columns
+func (self *SQLiteSink) keyColumns() []string {
+	return self.columns[:self.nkeys]
+}
+
+// createTable creates table for aggregated data or checks existing table has
+// the same columns.
+func (self *SQLiteSink) createTable() error {
+	defs := make([]string, 0, len(self.columns)+1)
+	for _, col := range self.keyColumns() {
+		defs = append(defs, sqliteQuote(col)+" TEXT NOT NULL")
+	}
+	for _, col := range self.columns[self.nkeys:] {
+		defs = append(defs, sqliteQuote(col)+" INTEGER NOT NULL DEFAULT 0")
+	}
+	defs = append(defs, "PRIMARY KEY ("+sqliteJoin(self.keyColumns())+")")
+
+	_, err := self.db.Exec("CREATE TABLE IF NOT EXISTS " + sqliteTable +
+		" (" + strings.Join(defs, ", ") + ")")
+	if err != nil {
+		return err
+	}
+
+	rows, err := self.db.Query("SELECT name FROM pragma_table_info(?)",
+		sqliteTable)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return err
+		}
+		columns = append(columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if strings.Join(columns, ",") != strings.Join(self.columns, ",") {
+		return fmt.Errorf("table %s has columns %v, expected %v",
+			sqliteTable, columns, self.columns)
+	}
+
+	return nil
+}
+
+// WriteHour adds data of bucket timeID into the table. It inserts new rows and
+// adds packets and bytes to existing rows and aggregates their metrics. If a
+// sum overflows, it returns [ErrCounterOverflow] and doesn't change the table,
+// or saturates the sum, if the overflow mode allows it.
+func (self *SQLiteSink) WriteHour(timeID string, data HourData) error {
+	updates := []string{self.sumColumn("packets"), self.sumColumn("bytes")}
+	for i, m := range self.metrics {
+		updates = append(updates,
+			self.aggColumn(self.columns[self.nkeys+2+i], m.agg))
+	}
+	placeholders := strings.TrimSuffix(
+		strings.Repeat("?, ", len(self.columns)), ", ")
+	query := "INSERT INTO " + sqliteTable +
+		" (" + sqliteJoin(self.columns) + ") VALUES (" + placeholders + ")" +
+		" ON CONFLICT (" + sqliteJoin(self.keyColumns()) + ") DO UPDATE SET " +
+		strings.Join(updates, ", ")
+
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // It does nothing after commit
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, len(self.columns))
+	for _, netflow := range data {
+		args = args[:0]
+		args = append(args, timeID)
+		for _, key := range netflow.Keys {
+			args = append(args, key)
+		}
+		packets, err := self.counter(netflow.Packets, "Packets", netflow)
+		if err != nil {
+			return err
+		}
+		bytes, err := self.counter(netflow.Bytes, "Bytes", netflow)
+		if err != nil {
+			return err
+		}
+		args = append(args, packets, bytes)
+		for i, m := range self.metrics {
+			n, err := self.counter(netflow.Metrics[i], m.name, netflow)
+			if err != nil {
+				return err
+			}
+			args = append(args, n)
+		}
+
+		if _, err := stmt.Exec(args...); err != nil {
+			var sqlErr *sqlite.Error
+			if errors.As(err, &sqlErr) &&
+				sqlErr.Code() == sqlite3.SQLITE_CONSTRAINT_NOTNULL {
+				return fmt.Errorf("%w: sum of %s in table %s", ErrCounterOverflow,
+					netflow.key(), sqliteTable)
+			}
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// sumColumn returns SQL, which adds new value to existing value of column col
+// on upsert. When the sum overflows int64, it's saturated or NULL, which
+// violates NOT NULL constraint and aborts the upsert.
+func (self *SQLiteSink) sumColumn(col string) string {
+	return sqliteQuote(col) + " = " + self.sum(col)
+}
+
+// sum returns SQL expression of sum of existing and new value of column col,
+// see [SQLiteSink.sumColumn].
+func (self *SQLiteSink) sum(col string) string {
+	overflow := "NULL"
+	if self.overflow == OverflowSaturate {
+		overflow = strconv.FormatInt(math.MaxInt64, 10)
+	}
+	col = sqliteQuote(col)
+	return fmt.Sprintf("CASE WHEN %s > %d - excluded.%s THEN %s"+
+		" ELSE %s + excluded.%s END",
+		col, int64(math.MaxInt64), col, overflow, col, col)
+}
+
+// aggColumn returns SQL, which aggregates new value with existing value of
+// column col on upsert by agg. Derived values are calculated from sums of
+// counters.
+func (self *SQLiteSink) aggColumn(col string, agg aggregation) string {
+	switch agg {
+	case aggMin, aggMax:
+		fn := "min"
+		if agg == aggMax {
+			fn = "max"
+		}
+		col = sqliteQuote(col)
+		return fmt.Sprintf("%s = %s(%s, excluded.%s)", col, fn, col, col)
+	case aggPerPacket:
+		return fmt.Sprintf("%s = coalesce((%s) / nullif(%s, 0), 0)",
+			sqliteQuote(col), self.sum("bytes"), self.sum("packets"))
+	}
+	return self.sumColumn(col)
+}
+
+// counter returns value n of counter name of netflow as int64, because SQLite
+// can't keep bigger integers. If it doesn't fit, it returns
+// [ErrCounterOverflow] or saturated value, if the overflow mode allows it.
+func (self *SQLiteSink) counter(
+	n uint64, name string, netflow *CSVRecord,
+) (int64, error) {
+	if n <= math.MaxInt64 {
+		return int64(n), nil
+	}
+	err := fmt.Errorf("%w: %s of %s doesn't fit into SQLite integer",
+		ErrCounterOverflow, name, netflow.key())
+	return math.MaxInt64, self.overflow.check(err)
+}
+
+// Close closes the database
+func (self *SQLiteSink) Close() error {
+	return self.db.Close()
+}
+
+// sqliteQuote quotes identifier s
+func sqliteQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// sqliteJoin quotes every identifier of ids and joins them by comma
+func sqliteJoin(ids []string) string {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = sqliteQuote(id)
+	}
+	return strings.Join(quoted, ", ")
+}
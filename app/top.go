@@ -0,0 +1,154 @@
+package app
+
+import (
+	"container/heap"
+	"fmt"
+	"slices"
+)
+
+// OtherKey is a value of every group-by column of roll-up row, which sums rows
+// not in top N.
+const OtherKey = "__other__"
+
+// TopBy defines counter, which ranks rows for top N. Zero value means
+// [SortBytes].
+type TopBy string
+
+// String returns name of the counter. It implements [flag.Value].
+func (self *TopBy) String() string {
+	if *self == "" {
+		return SortBytes
+	}
+	return string(*self)
+}
+
+// Set checks s is a known counter and assigns it. It implements [flag.Value].
+func (self *TopBy) Set(s string) error {
+	switch s {
+	case SortBytes, SortPackets:
+		*self = TopBy(s)
+		return nil
+	}
+	return fmt.Errorf("unknown counter %q, expected %s or %s",
+		s, SortBytes, SortPackets)
+}
+
+// order returns order of rows from the largest one
+func (self TopBy) order() SortOrder {
+	if self == "" {
+		return SortBytes
+	}
+	return SortOrder(self)
+}
+
+// newTopN returns initialized [*topN], which keeps opts.Top largest rows by
+// opts.TopBy.
+func newTopN(opts *Options) *topN {
+	return &topN{
+		n:         opts.Top,
+		order:     opts.TopBy.order(),
+		withOther: opts.TopOther,
+		overflow:  opts.Overflow,
+	}
+}
+
+// topN keeps N largest rows of one bucket in bounded min-heap, so it needs
+// memory for N rows only, regardless of num of rows it gets. Rows with equal
+// counter rank by key, so the result doesn't depend on order of rows. It can
+// sum every dropped row into roll-up row, so totals still match.
+type topN struct {
+	n         int
+	order     SortOrder    // order of rows from the largest one
+	withOther bool         // sum dropped rows into roll-up row
+	overflow  Overflow     // what to do, when sum of roll-up row overflows
+	rows      []*CSVRecord // min-heap, the smallest row is the root
+	other     *CSVRecord   // roll-up row, nil if nothing dropped yet
+}
+
+// Add adds row netflow. If it isn't in top N, or it pushes another row out of
+// top N, it drops that row.
+func (self *topN) Add(netflow *CSVRecord) error {
+	// Roll-up row of prev run, merged with new data, stays roll-up row
+	if netflow.isOther() {
+		return self.addOther(netflow)
+	}
+
+	if len(self.rows) < self.n {
+		heap.Push(self, netflow)
+		return nil
+	} else if !self.order.less(netflow, self.rows[0]) {
+		return self.drop(netflow)
+	}
+
+	dropped := self.rows[0]
+	self.rows[0] = netflow
+	heap.Fix(self, 0)
+	return self.drop(dropped)
+}
+
+// drop adds netflow into roll-up row, if we need it
+func (self *topN) drop(netflow *CSVRecord) error {
+	if !self.withOther {
+		return nil
+	}
+	return self.addOther(netflow)
+}
+
+// addOther adds netflow into roll-up row
+func (self *topN) addOther(netflow *CSVRecord) error {
+	if self.other == nil {
+		// Copy of the first dropped row keeps its metrics, some of them can't
+		// start from zero, like the smallest value.
+		other := *netflow
+		other.Keys = make([]string, len(netflow.Keys))
+		for i := range other.Keys {
+			other.Keys[i] = OtherKey
+		}
+		other.ID = other.genUniqID()
+		other.Metrics = slices.Clone(netflow.Metrics)
+		self.other = &other
+		return nil
+	}
+	return self.overflow.check(self.other.Add(netflow))
+}
+
+// isOther returns true if the record is roll-up row, see [OtherKey]
+func (self *CSVRecord) isOther() bool {
+	for _, key := range self.Keys {
+		if key != OtherKey {
+			return false
+		}
+	}
+	return len(self.Keys) > 0
+}
+
+// data returns top N rows and roll-up row, if any
+func (self *topN) data() HourData {
+	data := make(HourData, len(self.rows)+1)
+	for _, netflow := range self.rows {
+		data[netflow.ID] = netflow
+	}
+	if self.other != nil {
+		data[self.other.ID] = self.other
+	}
+	return data
+}
+
+func (self *topN) Len() int { return len(self.rows) }
+
+// Less makes the smallest row the root of heap
+func (self *topN) Less(i, j int) bool {
+	return self.order.less(self.rows[j], self.rows[i])
+}
+
+func (self *topN) Swap(i, j int) {
+	self.rows[i], self.rows[j] = self.rows[j], self.rows[i]
+}
+
+func (self *topN) Push(x any) { self.rows = append(self.rows, x.(*CSVRecord)) }
+
+func (self *topN) Pop() any {
+	row := self.rows[len(self.rows)-1]
+	self.rows = self.rows[:len(self.rows)-1]
+	return row
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopBy(t *testing.T) {
+	assert := assert.New(t)
+
+	var by TopBy
+	assert.Equal(SortBytes, by.String())
+	assert.NoError(by.Set(SortPackets))
+	assert.Equal(SortPackets, by.String())
+	assert.Error(by.Set(SortKey))
+}
+
+// orderedRows returns rows of data, which [bucketWriter.ordered] writes
+// according to opts.
+func orderedRows(t *testing.T, data HourData, opts *Options) []*CSVRecord {
+	w := newBucketWriter(t.TempDir(), opts)
+	defer w.stage.Remove()
+
+	var rows []*CSVRecord
+	src := recordRows(SortOrder(SortKey).Sorted(data))
+	require.NoError(t, w.ordered(src, 256<<20, func(netflow *CSVRecord) error {
+		rows = append(rows, netflow)
+		return nil
+	}))
+	return rows
+}
+
+func TestTopCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := NewOptions()
+	for _, n := range []int{0, 1, 1 << 62} {
+		opts.Top = n
+		assert.NoError(opts.Check(), n)
+		// Huge N doesn't take memory until rows come
+		assert.Zero(cap(newTopN(opts).rows), n)
+	}
+
+	opts.Top = -1
+	assert.Error(opts.Check())
+	opts.Top, opts.Approx = 0, -1
+	assert.Error(opts.Check())
+}
+
+func TestBucketWriterTop(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Top works with rows of one bucket
+	data := make(HourData)
+	var total CSVRecord
+	for _, rec := range makeSpillRecords(1000) {
+		if rec.TimeID == "2017-04-26-10" {
+			require.NoError(total.Add(rec))
+			require.NoError(data.Add(rec))
+		}
+	}
+
+	opts := NewOptions()
+	opts.Top = 3
+	top := orderedRows(t, data, opts)
+	require.Len(top, 3)
+	want := SortOrder(SortBytes).Sorted(data)[:3]
+	assert.Equal(SortOrder(SortKey).Sorted(HourData{
+		want[0].ID: want[0], want[1].ID: want[1], want[2].ID: want[2],
+	}), top)
+
+	opts.TopOther = true
+	require.NoError(opts.TopBy.Set(SortPackets))
+	require.NoError(opts.Sort.Set(SortPackets))
+	top = orderedRows(t, data, opts)
+	require.Len(top, 4)
+	// Roll-up row is the largest one here
+	other := &CSVRecord{TimeID: "2017-04-26-10", Keys: []string{OtherKey, OtherKey}}
+	assert.Equal(other.genUniqID(), top[0].ID)
+	for i, rec := range SortOrder(SortPackets).Sorted(data)[:3] {
+		assert.Equal(rec.ID, top[i+1].ID)
+	}
+
+	var sum CSVRecord
+	for _, rec := range top {
+		require.NoError(sum.Add(rec))
+	}
+	assert.Equal(total.Packets, sum.Packets)
+	assert.Equal(total.Bytes, sum.Bytes)
+}
+
+func TestSpillerTop(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Top = 5
+	opts.TopOther = true
+
+	var want *memSink
+	for _, limit := range []ByteSize{256 << 20, 1} {
+		spiller := NewSpiller(t.TempDir(), limit, 2, opts)
+		for _, rec := range makeSpillRecords(1000) {
+			require.NoError(spiller.Add(rec))
+		}
+		sink := newMemSink()
+		require.NoError(spiller.Commit(sink))
+		require.NoError(spiller.Close())
+
+		assert.Len(sink.data, 3)
+		for _, data := range sink.data {
+			assert.Len(data, 6)
+		}
+		if want == nil {
+			want = sink
+			continue
+		}
+		// Spilled data has the same top rows
+		for timeID, data := range want.data {
+			for id, rec := range data {
+				require.Contains(sink.data[timeID], id)
+				assert.Equal(rec.Bytes, sink.data[timeID][id].Bytes)
+				assert.Equal(rec.Packets, sink.data[timeID][id].Packets)
+			}
+		}
+	}
+}
+
+func TestSpillerTopMerge(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := NewOptions()
+	opts.Top = 2
+	opts.TopOther = true
+	require.NoError(opts.TopBy.Set(SortPackets))
+	opts.Merge = true
+
+	totals := make(map[string]uint64)
+	for _, rec := range makeSpillRecords(1000) {
+		totals[rec.TimeID] += 2 * rec.Packets
+	}
+
+	// Roll-up row of the first run is the largest one, the second run must add
+	// to it, not replace it.
+	outDir := t.TempDir()
+	for _, limit := range []ByteSize{256 << 20, 1} {
+		spiller := NewSpiller(t.TempDir(), limit, 1, opts)
+		for _, rec := range makeSpillRecords(1000) {
+			require.NoError(spiller.Add(rec))
+		}
+		require.NoError(spiller.Commit(NewOutDir(outDir, t.TempDir(), opts)))
+		require.NoError(spiller.Close())
+	}
+
+	for timeID, total := range totals {
+		data, err := loadHourFile(path.Join(outDir, timeID+".csv"), opts)
+		require.NoError(err)
+		assert.Len(data, 3, timeID)
+
+		var sum uint64
+		for _, rec := range data {
+			sum += rec.Packets
+		}
+		assert.Equal(total, sum, timeID)
+	}
+}
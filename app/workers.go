@@ -0,0 +1,38 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Workers is a num of goroutines, which parse input and write output files. 0
+// means GOMAXPROCS. It implements [flag.Value].
+type Workers int
+
+// ParseWorkers parses s and returns it as [Workers]. The num must not be
+// negative.
+func ParseWorkers(s string) (Workers, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid num of workers %q: %w", s, err)
+	} else if n < 0 {
+		return 0, fmt.Errorf("invalid num of workers %q: must not be negative", s)
+	}
+	return Workers(n), nil
+}
+
+// String returns the num as decimal. It implements [flag.Value].
+func (self Workers) String() string {
+	return strconv.Itoa(int(self))
+}
+
+// Set parses s like [ParseWorkers] does and assigns the result. It implements
+// [flag.Value].
+func (self *Workers) Set(s string) error {
+	n, err := ParseWorkers(s)
+	if err != nil {
+		return err
+	}
+	*self = n
+	return nil
+}
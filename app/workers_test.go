@@ -0,0 +1,26 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWorkers(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for s, want := range map[string]Workers{"0": 0, "1": 1, "16": 16} {
+		n, err := ParseWorkers(s)
+		require.NoError(err, s)
+		assert.Equal(want, n, s)
+		assert.Equal(s, n.String(), s)
+	}
+
+	for _, s := range []string{"", "-1", "-2", "x", "1.5"} {
+		var n Workers
+		assert.Error(n.Set(s), s)
+		assert.Equal(Workers(0), n, s)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"dsh/fc/app"
+)
+
+// stdinName is a name of input, which means read it from stdin
+const stdinName = "-"
+
+// inputList is a list of input .csv files. Every -i option adds one more
+// file, shell-style glob or "-" for stdin.
+type inputList []string
+
+// String returns comma separated list of inputs. It implements [flag.Value].
+func (self *inputList) String() string {
+	return strings.Join(*self, ",")
+}
+
+// Set appends s to the list. It implements [flag.Value].
+func (self *inputList) Set(s string) error {
+	*self = append(*self, s)
+	return nil
+}
+
+// expand returns list of input files, where every glob replaced by files it
+// matches. It's an error if glob doesn't match any file.
+func (self inputList) expand() ([]string, error) {
+	var fnames []string
+	for _, name := range self {
+		if name == stdinName || !strings.ContainsAny(name, "*?[") {
+			fnames = append(fnames, name)
+			continue
+		}
+
+		matches, err := filepath.Glob(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		} else if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no files match", name)
+		}
+		fnames = append(fnames, matches...)
+	}
+
+	return fnames, nil
+}
+
+// readInput reads input .csv file fname, or stdin if fname is "-", parses it
+// according to its own header line and opts by workers goroutines and passes
+// every parsed line to add. Lines, which can't be parsed, it passes to badRows.
+// See [app.ParseInput].
+func readInput(
+	fname string, opts *app.Options, workers int, badRows *app.BadRows,
+	add func(netflow *app.CSVRecord) error,
+) error {
+	// Input can be compressed, OpenInput decompresses it on the fly
+	file, err := app.OpenInput(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return app.ParseInput(file, fname, opts, workers, badRows, add)
+}
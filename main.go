@@ -1,55 +1,123 @@
 package main
 
 import (
-	"encoding/csv"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"dsh/fc/app"
 )
 
 const (
-	defLowMem = false // work faster by default
-	defOutDir = "."   // output dir is current one by default
+	defLowMem      = false    // work faster by default
+	defLowMemLimit = 64 << 20 // memory limit with --lowmem, 64MB
+	defMemLimit    = 1 << 30  // memory limit by default, 1GB
+	defOutDir      = "."      // output dir is current one by default
 
 	// Usage strings for CLI options
-	inCSVUsage  = "name of input .csv file"
-	lowMemUsage = "slower, but use less RAM"
-	outDirUsage = "dir for output .csv files"
+	approxUsage      = "approximate top N rows of every bucket by --by counter in fixed memory, with error bounds in PacketsError and BytesError columns, 0 means exact aggregation. Can't be used with --metrics"
+	badRowsUsage     = "write rejected input lines into this .csv file and continue"
+	bucketUsage      = "time granularity of aggregation: 1m, 5m, 15m, 1h, 1d, 1w or any other duration"
+	compressUsage    = "compress output files: none, gzip or zstd. Parquet compresses its pages instead"
+	directionalUsage = "add columns FwdPackets, BwdPackets, FwdBytes and BwdBytes, from source to destination and back, next to their sums Packets and Bytes"
+	formatUsage      = "format of output files: csv, jsonl or parquet"
+	groupByUsage     = "comma separated list of input columns to aggregate by"
+	inCSVUsage       = "name of input .csv file, can be compressed by gzip, zstd, bzip2 or xz. Can be repeated, can be a glob or - for stdin"
+	lenientUsage     = "fill absent counters with zeros instead of failing"
+	lowMemUsage      = "slower, but use less RAM, the same as --mem-limit 64MB"
+	maxErrorsUsage   = "with --bad-rows abort when more than this num of lines rejected, 0 means no limit"
+	memLimitUsage    = "spill aggregated data on disk, when it takes this much of RAM, like 64MB or 1G"
+	mergeUsage       = "add aggregated data to existing output files instead of overwriting them"
+	metricsUsage     = "add columns Flows, DurationMin, DurationMax and DurationSum in microseconds, FirstSeen and LastSeen in microseconds since Unix epoch and AvgPacketSize"
+	outDirUsage      = "dir for output .csv files"
+	overflowUsage    = "what to do, when sum of counters doesn't fit into 64 bits: error or saturate (default error)"
+	schemaUsage      = "schema of input .csv: auto, %s or name of YAML/JSON mapping file (default auto)"
+	sinkUsage        = "where to store aggregated data: dir for output dir or sqlite:file.db for table of SQLite database, which accumulates data of repeated runs (default dir)"
+	sortUsage        = "order of rows in output files: key, bytes or packets (default key)"
+	tmpDirUsage      = "keep spilled data in private staging dir inside this dir (default is system temp dir)"
+	topUsage         = "write only N rows of every bucket with the largest --by counter, 0 means every row"
+	topByUsage       = "counter of --top: bytes or packets (default bytes)"
+	topOtherUsage    = "with --top or --approx add row __other__ with sum of the rest rows. With --top totals still match. With --approx top rows include counts of evicted rows up to their errors, so __other__ is a lower bound"
+	workersUsage     = "num of goroutines parsing input and writing output files, 0 means num of CPUs, can't be negative"
 )
 
 var (
-	inCSV  string // name of input .csv file
-	lowMem bool   // use less RAM
-	outDir string // name of output dir
+	badRowsFile string      // name of quarantine .csv file
+	inCSV       inputList   // names of input .csv files
+	lowMem      bool        // use less RAM
+	maxErrors   int         // max num of rejected lines
+	outDir      string      // name of output dir
+	sinkSpec    string      // where to store aggregated data
+	tmpDir      string      // parent dir of staging dir
+	workers     app.Workers // num of parsing goroutines
+
+	memLimit = app.ByteSize(defMemLimit) // memory limit of aggregated data
+	opts     = app.NewOptions()          // settings of aggregation
 )
 
 func init() {
-	flag.StringVar(&inCSV, "i", "", inCSVUsage)
+	flag.Var(&inCSV, "i", inCSVUsage)
 	flag.StringVar(&outDir, "o", defOutDir, outDirUsage)
 
-	flag.StringVar(&inCSV, "input", "", inCSVUsage)
+	flag.Var(&inCSV, "input", inCSVUsage)
 	flag.BoolVar(&lowMem, "lowmem", defLowMem, lowMemUsage)
 	flag.StringVar(&outDir, "output", defOutDir, outDirUsage)
+	flag.Var(&memLimit, "mem-limit", memLimitUsage)
+	flag.StringVar(&tmpDir, "tmpdir", "", tmpDirUsage)
+	flag.Var(&workers, "workers", workersUsage)
+
+	flag.StringVar(&badRowsFile, "bad-rows", "", badRowsUsage)
+	flag.IntVar(&maxErrors, "max-errors", 0, maxErrorsUsage)
+	flag.StringVar(&sinkSpec, "sink", "", sinkUsage)
+
+	flag.IntVar(&opts.Approx, "approx", 0, approxUsage)
+	flag.Var(&opts.Bucket, "bucket", bucketUsage)
+	flag.Var(&opts.Compress, "compress", compressUsage)
+	flag.BoolVar(&opts.Directional, "directional", false, directionalUsage)
+	flag.Var(&opts.Format, "format", formatUsage)
+	flag.Var(&opts.GroupBy, "group-by", groupByUsage)
+	flag.BoolVar(&opts.Lenient, "lenient", false, lenientUsage)
+	flag.BoolVar(&opts.Merge, "merge", false, mergeUsage)
+	flag.BoolVar(&opts.Metrics, "metrics", false, metricsUsage)
+	flag.Var(&opts.Overflow, "overflow", overflowUsage)
+	flag.Var(&opts.Sort, "sort", sortUsage)
+	flag.IntVar(&opts.Top, "top", 0, topUsage)
+	flag.Var(&opts.TopBy, "by", topByUsage)
+	flag.BoolVar(&opts.TopOther, "top-other", false, topOtherUsage)
+	flag.Func("schema",
+		fmt.Sprintf(schemaUsage, strings.Join(app.SchemaNames(), ", ")),
+		func(s string) (err error) {
+			opts.Schema, err = app.LoadSchema(s)
+			return
+		})
 
 	flag.Parse()
 
 	// input .csv file is mandatory
-	if inCSV == "" {
+	if len(inCSV) == 0 {
 		flag.Usage()
 		os.Exit(2)
 	}
+
+	// --lowmem lowers memory limit, unless it's set explicitly
+	if lowMem && !flagPassed("mem-limit") {
+		memLimit = defLowMemLimit
+	}
 }
 
 func main() {
 	log.SetFlags(0) // disable datetime
 
-	file, err := os.Open(inCSV)
+	if err := opts.Check(); err != nil {
+		log.Fatalln(err)
+	}
+
+	inputs, err := inCSV.expand()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer file.Close()
 
 	// Create output dir if it isn't exist. If it already exist MkdirAll does
 	// nothing.
@@ -57,48 +125,78 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	r := csv.NewReader(file)
-	r.ReuseRecord = true // Reuse some memory for performance
+	badRows, err := app.NewBadRows(badRowsFile, maxErrors)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer badRows.Close()
 
-	// Depending on existence of --lowmem option use one of algorithms
-	if lowMem {
-		processCSVLowMem(r, outDir)
-	} else {
-		processCSV(r, outDir)
+	sink, err := app.OpenSink(sinkSpec, outDir, tmpDir, opts)
+	if err != nil {
+		log.Fatalln(err)
 	}
-}
 
-// processCSV reads input .csv file, parses it and aggregates by day-hour, dest
-// IP and proto name. It keeps aggregated data in memory and works faster. It
-// saves aggregated data into .csv files named by day-hour.csv in outPath dir.
-func processCSV(r *csv.Reader, outPath string) {
-	h, err := app.NewHeader(r)
+	err = processCSV(inputs, tmpDir, memLimit, int(workers), sink, opts,
+		badRows)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	// In allData we keep all our aggregated data indexed by day-hour string
-	allData := make(map[string]app.HourData)
-	for {
-		netflow, err := app.NewRecord(h, r)
-		if err != nil {
-			log.Fatalln(err)
-		} else if netflow == nil {
-			break
-		}
+	if err := sink.Close(); err != nil {
+		log.Fatalln(err)
+	}
 
-		// For unknown day-hour we need to create a new one
-		if _, present := allData[netflow.TimeID]; !present {
-			allData[netflow.TimeID] = make(app.HourData)
-		}
-		// Add new values into aggregated data
-		allData[netflow.TimeID].Add(netflow)
+	if n := badRows.Count(); n > 0 {
+		log.Printf("%d bad rows rejected into %s", n, badRowsFile)
 	}
+}
 
-	// Save every day-hour data into its .csv file in outPath dir
-	for timeID, data := range allData {
-		if err := app.SaveHourToFile(timeID, data, outPath); err != nil {
-			log.Fatalln(err)
+// flagPassed returns true if flag name was set in command line
+func flagPassed(name string) (passed bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return
+}
+
+// processCSV reads input .csv files, parses them and aggregates together by
+// day-hour (or another bucket from opts) and group-by columns from opts, dest
+// IP and proto name by default. It writes aggregated data into sink, .csv
+// files named by day-hour.csv in output dir by default, bucket by bucket in
+// time order. Lines of input, which can't be parsed, it passes to badRows.
+//
+// It keeps aggregated data in memory and works fast, while estimated size of
+// aggregated data is less than memLimit. When it reaches memLimit, it spills
+// aggregated data, sorted by day-hour and group-by key, into run file in
+// private staging dir, created in tmpDir (default dir for temporary files if
+// it's empty), and continues with empty memory. At the end it merges all runs
+// at once, like external sort does. So memory is limited regardless of order
+// of input and num of keys per day-hour. The staging dir is removed on success
+// and on failure.
+//
+// With opts.Approx it keeps approximate top rows of every bucket in fixed
+// memory instead, see [app.Approx].
+//
+// Input lines are parsed and output files are written by workers goroutines in
+// parallel.
+func processCSV(
+	inputs []string, tmpDir string, memLimit app.ByteSize, workers int,
+	sink app.Sink, opts *app.Options, badRows *app.BadRows,
+) error {
+	aggregator := app.NewAggregator(tmpDir, memLimit, workers, opts)
+	defer aggregator.Close()
+
+	// Let's aggregate the input files, spilling aggregated data into run files
+	// when needed.
+	for _, fname := range inputs {
+		err := readInput(fname, opts, workers, badRows, aggregator.Add)
+		if err != nil {
+			return err
 		}
 	}
+
+	// Now let's write aggregated data into sink, merging run files if any
+	return aggregator.Commit(sink)
 }